@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/checker"
+	"github.com/etidart/proxyflow/internal/logging"
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// proxyflow check: checks a proxy list without running the relay
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	pfile := fs.String("pfile", "", "path to file containing proxies (any supported format)")
+	proto := fs.String("proto", "", "protocol of pfile entries without a scheme (ip:port or ip:port:user:pass): http, https, socks4, socks5, or detect to probe each. empty makes them bad entries")
+	strict := fs.Bool("strict", false, "fail if the pfile has a bad entry")
+	attempts := fs.Int("n", 3, "how many times each proxy is checked")
+	parallel := fs.Int("parallel", 50, "how many proxies are checked at once")
+	output := fs.String("output", "table", "output format: table, json or csv")
+	exitipurl := fs.String("exitipurl", "", "url (http or https) answering with client's ip in plain text, used to learn proxies' exit ips. empty disables")
+	out := fs.String("out", "", "path to write working proxies to (pfile syntax, best first), empty disables")
+	minok := fs.Int("minok", 1, "how many successful checks make a proxy working")
+	loglevel := fs.String("loglevel", "warn", "min level of logged messages: debug, info, warn or error")
+	fs.Parse(args)
+
+	// stdout is for the results
+	logcfg := logging.Config{Stderr: true}
+	var err error
+	if logcfg.Level, err = logging.ParseLevel(*loglevel); err != nil {
+		logging.Fatal("bad loglevel arg", "error", err)
+	}
+	if err := logging.Init(logcfg); err != nil {
+		logging.Fatal("unable to init logging", "error", err)
+	}
+	if *pfile == "" {
+		logging.Fatal("pfile arg is empty")
+	}
+	if *attempts < 1 {
+		logging.Fatal("n must be at least 1")
+	}
+	var write func(io.Writer, []checker.Result) error
+	switch *output {
+	case "table":
+		write = writeTable
+	case "json":
+		write = writeJSON
+	case "csv":
+		write = writeCSV
+	default:
+		logging.Fatal("bad output arg", "output", *output)
+	}
+
+	var ip *checker.IPProbe
+	if *exitipurl != "" {
+		if ip, err = checker.NewIPProbe(*exitipurl); err != nil {
+			logging.Fatal("bad exitipurl arg", "url", *exitipurl, "error", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the manager launches xray for share links
+	pm := proxy.NewProxyManager()
+	err = pm.ParseFile(*pfile, proxy.ParseOptions{Proto: *proto, Strict: *strict, Detect: checker.Detector(ctx, *parallel)})
+	failOnBadEntries(err)
+	if err != nil {
+		logging.Fatal("unable to parse pfile", "file", *pfile, "error", err)
+	}
+	defer pm.StopXray()
+	results := checker.CheckAll(ctx, pm.List(), *attempts, *parallel, ip)
+
+	if err := write(os.Stdout, results); err != nil {
+		logging.Fatal("unable to write results", "error", err)
+	}
+	if *out != "" {
+		if err := writeWorking(*out, results, *minok); err != nil {
+			logging.Fatal("unable to write working proxies", "file", *out, "error", err)
+		}
+	}
+}
+
+func ms(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+}
+
+func errText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return proxy.ClassOf(err).String() + ": " + err.Error()
+}
+
+func writeTable(w io.Writer, results []checker.Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROXY\tSTATUS\tOK\tMIN MS\tAVG MS\tMAX MS\tEXIT IP\tLAST ERROR")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%s\t%s\t%s\t%s\t%s\n", proxy.URL(r.Proxy), r.Status(), r.OK, r.Attempts,
+			ms(r.Min), ms(r.Avg), ms(r.Max), r.ExitIP, errText(r.LastErr))
+	}
+	return tw.Flush()
+}
+
+type resultEntry struct {
+	Proxy    string  `json:"proxy"`
+	Status   string  `json:"status"`
+	Attempts int     `json:"attempts"`
+	OK       int     `json:"ok"`
+	MinMS    float64 `json:"min_ms,omitempty"`
+	AvgMS    float64 `json:"avg_ms,omitempty"`
+	MaxMS    float64 `json:"max_ms,omitempty"`
+	ExitIP   string  `json:"exit_ip,omitempty"`
+	LastErr  string  `json:"last_error,omitempty"`
+}
+
+func writeJSON(w io.Writer, results []checker.Result) error {
+	entries := make([]resultEntry, len(results))
+	for i, r := range results {
+		entries[i] = resultEntry{
+			Proxy:    proxy.URL(r.Proxy),
+			Status:   r.Status(),
+			Attempts: r.Attempts,
+			OK:       r.OK,
+			MinMS:    float64(r.Min) / float64(time.Millisecond),
+			AvgMS:    float64(r.Avg) / float64(time.Millisecond),
+			MaxMS:    float64(r.Max) / float64(time.Millisecond),
+			ExitIP:   r.ExitIP,
+			LastErr:  errText(r.LastErr),
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+func writeCSV(w io.Writer, results []checker.Result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"proxy", "status", "attempts", "ok", "min_ms", "avg_ms", "max_ms", "exit_ip", "last_error"})
+	for _, r := range results {
+		cw.Write([]string{proxy.URL(r.Proxy), r.Status(), strconv.Itoa(r.Attempts), strconv.Itoa(r.OK),
+			ms(r.Min), ms(r.Avg), ms(r.Max), r.ExitIP, errText(r.LastErr)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writes proxies with at least minok successes in pfile syntax
+func writeWorking(filename string, results []checker.Result, minok int) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for _, r := range results {
+		if r.OK >= minok {
+			fmt.Fprintln(bw, proxy.Line(r.Proxy))
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/etidart/proxyflow/internal/checker"
+	"github.com/etidart/proxyflow/internal/constants"
+	"github.com/etidart/proxyflow/internal/logging"
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// proxyflow convert: rewrites a proxy list in another format, or dumps the live pool
+// of a running instance
+func runConvert(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	in := fs.String("in", "", "path or http(s) url of the list to convert")
+	from := fs.String("from", proxy.FormatAuto, "input format: auto, lines, base64, clash, singbox, xray or pool")
+	to := fs.String("to", proxy.FormatLines, "output format: lines, base64, pool, json, clash, xray or vendor (ip:port[:user:pass])")
+	out := fs.String("out", "", "path to write to, empty writes to stdout")
+	admin := fs.String("admin", "", "admin address of a running instance (its -admin arg) to dump the live pool from instead of -in. pool and json formats include statistics")
+	proto := fs.String("proto", "", "protocol of input entries without a scheme (ip:port or ip:port:user:pass): http, https, socks4, socks5, or detect to probe each. empty makes them bad entries")
+	strict := fs.Bool("strict", false, "fail if the input has a bad entry or the output format can't express a proxy")
+	loglevel := fs.String("loglevel", "warn", "min level of logged messages: debug, info, warn or error")
+	fs.Parse(args)
+
+	// stdout is for the results
+	logcfg := logging.Config{Stderr: true}
+	var err error
+	if logcfg.Level, err = logging.ParseLevel(*loglevel); err != nil {
+		logging.Fatal("bad loglevel arg", "error", err)
+	}
+	if err := logging.Init(logcfg); err != nil {
+		logging.Fatal("unable to init logging", "error", err)
+	}
+	if (*in == "") == (*admin == "") {
+		logging.Fatal("exactly one of in and admin args is needed")
+	}
+	if !proxy.IsFormat(*from) {
+		logging.Fatal("bad from arg", "format", *from)
+	}
+	if !proxy.IsOutputFormat(*to) {
+		logging.Fatal("bad to arg", "format", *to)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			logging.Fatal("unable to create output file", "file", *out, "error", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *admin != "" {
+		// the running instance does the conversion, it has the statistics
+		data, header, err := fetch("http://" + *admin + "/pool?format=" + url.QueryEscape(*to))
+		if err != nil {
+			logging.Fatal("unable to dump the live pool", "admin", *admin, "error", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			logging.Fatal("unable to write", "error", err)
+		}
+		if skipped, _ := strconv.Atoi(header.Get("X-Skipped-Proxies")); skipped != 0 {
+			warnSkipped(&proxy.SkippedError{Format: *to, Skipped: skipped}, *strict)
+		}
+		return
+	}
+
+	var data []byte
+	if strings.HasPrefix(*in, "http://") || strings.HasPrefix(*in, "https://") {
+		data, _, err = fetch(*in)
+	} else {
+		data, err = os.ReadFile(*in)
+	}
+	if err != nil {
+		logging.Fatal("unable to read input", "in", *in, "error", err)
+	}
+	proxies, err := proxy.Parse(data, proxy.ParseOptions{
+		Format: *from,
+		Name:   *in,
+		Proto:  *proto,
+		Strict: *strict,
+		Detect: checker.Detector(context.Background(), constants.SRCDETECTN),
+	})
+	failOnBadEntries(err)
+	if err != nil {
+		logging.Fatal("unable to parse input", "in", *in, "error", err)
+	}
+	err = proxy.Write(*to, w, proxies)
+	var serr *proxy.SkippedError
+	if errors.As(err, &serr) {
+		warnSkipped(serr, *strict)
+		return
+	}
+	if err != nil {
+		logging.Fatal("unable to write", "error", err)
+	}
+}
+
+// proxies the output format couldn't express are a warning, or an error if strict
+func warnSkipped(err *proxy.SkippedError, strict bool) {
+	if strict {
+		logging.Fatal("unable to write", "error", err)
+	}
+	logging.Warn(err.Error())
+}
+
+func fetch(rawurl string) ([]byte, http.Header, error) {
+	client := http.Client{Timeout: constants.SRCFETCHTO}
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, nil, errors.New(resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, constants.SRCMAXSIZE))
+	return data, resp.Header, err
+}
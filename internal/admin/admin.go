@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package admin
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/etidart/proxyflow/internal/logging"
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// ListenAndServe serves the admin interface on listenon:
+//
+//	GET /pool[?format=...]  the live pool in any output format (json by default),
+//	                        pool and json ones include proxies' statistics, proxies
+//	                        the format can't express are counted in X-Skipped-Proxies
+//
+// the pool includes proxies' credentials, so listenon should not be public
+func ListenAndServe(listenon string, pm *proxy.ProxyManager) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /pool", func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = proxy.FormatJSON
+		}
+		if !proxy.IsOutputFormat(format) {
+			http.Error(w, "unknown format "+format, http.StatusBadRequest)
+			return
+		}
+		var buf bytes.Buffer
+		err := pm.Export(format, &buf)
+		var serr *proxy.SkippedError
+		if errors.As(err, &serr) {
+			// the rest of the pool is still worth having
+			w.Header().Set("X-Skipped-Proxies", strconv.Itoa(serr.Skipped))
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if format == proxy.FormatJSON || format == proxy.FormatXray {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write(buf.Bytes())
+	})
+	logging.Info("serving admin interface", "listen", listenon)
+	if err := http.ListenAndServe(listenon, mux); err != nil {
+		logging.Fatal("admin listener failed", "listen", listenon, "error", err)
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package checker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// BWProbe describes where and how much to download while measuring throughput
+type BWProbe struct {
+	remote *remote
+	size   int64
+}
+
+// NewBWProbe validates rawurl (http or https) and resolves its host
+func NewBWProbe(rawurl string, size int64) (*BWProbe, error) {
+	if size <= 0 {
+		return nil, errors.New("size must be positive")
+	}
+	r, err := newRemote(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &BWProbe{remote: r, size: size}, nil
+}
+
+// downloads up to bw.size bytes through prx and returns the throughput in bytes per second
+func (bw *BWProbe) measure(ctx context.Context, prx *proxy.Proxy) (float64, error) {
+	resp, conn, _, err := bw.remote.get(ctx, prx, constants.CHKBWTO)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	n, err := io.CopyN(io.Discard, resp.Body, bw.size)
+	elapsed := time.Since(start)
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("downloading: %w", err)
+	}
+	if n == 0 || elapsed <= 0 {
+		return 0, errors.New("nothing was downloaded")
+	}
+	return float64(n) / elapsed.Seconds(), nil
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package checker
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/logging"
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// Result is what CheckAll learned about a proxy
+type Result struct {
+	Proxy    *proxy.Proxy
+	Attempts int
+	OK       int           // successful attempts
+	Min      time.Duration // handshake times of successful attempts
+	Avg      time.Duration
+	Max      time.Duration
+	LastErr  error  // error of the last failed attempt
+	ExitIP   string // learned after the first success, if asked for
+}
+
+// Status is ok if every attempt succeeded, flaky if some did and dead if none.
+// unchecked if checking was stopped before the proxy's turn
+func (r Result) Status() string {
+	switch r.OK {
+	case 0:
+		if r.Attempts == 0 {
+			return "unchecked"
+		}
+		return "dead"
+	case r.Attempts:
+		return "ok"
+	}
+	return "flaky"
+}
+
+// CheckAll checks every proxy n times in a row, at most parallel proxies at once.
+// ip (may be nil) is used to learn exit ips. results are sorted by successes, then
+// by average handshake time
+func CheckAll(ctx context.Context, proxies []*proxy.Proxy, n int, parallel int, ip *IPProbe) []Result {
+	results := make([]Result, len(proxies))
+	sem := make(chan struct{}, max(parallel, 1))
+	var wg sync.WaitGroup
+	for i, prx := range proxies {
+		results[i].Proxy = prx
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			checkN(ctx, &results[i], n, ip)
+		})
+	}
+	wg.Wait()
+
+	slices.SortStableFunc(results, func(a, b Result) int {
+		if a.OK != b.OK {
+			return b.OK - a.OK
+		}
+		return cmp.Compare(a.Avg, b.Avg)
+	})
+	return results
+}
+
+// checks res.Proxy n times filling res
+func checkN(ctx context.Context, res *Result, n int, ip *IPProbe) {
+	prx := res.Proxy
+	var total time.Duration
+	for range n {
+		if ctx.Err() != nil {
+			break
+		}
+		res.Attempts++
+		err, dur := check(ctx, prx, logging.Logger())
+		if err != nil {
+			res.LastErr = err
+			continue
+		}
+		res.OK++
+		total += dur
+		if res.Min == 0 || dur < res.Min {
+			res.Min = dur
+		}
+		res.Max = max(res.Max, dur)
+		if ip != nil && res.ExitIP == "" {
+			res.ExitIP, _ = ip.exitIP(ctx, prx)
+		}
+	}
+	if res.OK != 0 {
+		res.Avg = total / time.Duration(res.OK)
+	}
+}
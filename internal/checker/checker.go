@@ -13,8 +13,11 @@ package checker
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
@@ -38,7 +41,7 @@ func getconnto() *connector.ConnectWho {
 		}
 		ipAddresses, err := net.LookupIP(constants.CHKHOST)
 		if err != nil {
-			logging.Fatal("IP of " + constants.CHKHOST + " wasn't resolved: " + err.Error())
+			logging.Fatal("checking host wasn't resolved", "host", constants.CHKHOST, "error", err)
 		}
 		for _, ip := range ipAddresses {
 			if ip.To4() != nil {
@@ -47,68 +50,160 @@ func getconnto() *connector.ConnectWho {
 			}
 		}
 		if connwho.IP == "" {
-			logging.Fatal("IP of " + constants.CHKHOST + " wasn't resolved")
+			logging.Fatal("checking host has no ipv4 address", "host", constants.CHKHOST)
 		}
 	})
 	return connwho
 }
 
-func check(prx *proxy.Proxy) (string, time.Duration) {
-	conn, err, dur := connector.ConnectToPrx(prx, *getconnto())
-	if err != "" {
-		return "crit (checking phase): " + err, dur
+func check(ctx context.Context, prx *proxy.Proxy, log *slog.Logger) (error, time.Duration) {
+	if prx.Check != nil && prx.Check.URL != "" {
+		r, err := remoteFor(prx.Check.URL)
+		if err == nil {
+			return checkRemote(ctx, prx, r)
+		}
+		log.Warn("check url is unusable, checking as usual", "url", prx.Check.URL, "error", err)
+	}
+	conn, err, dur := connector.ConnectToPrx(ctx, prx, *getconnto())
+	if err != nil {
+		return err, dur
 	}
 	defer conn.Close()
 
 	conn.SetDeadline(time.Now().Add(constants.CHKTO))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
 	tlsConn := tls.Client(conn, &tls.Config{ServerName: constants.CHKHOST})
-	erro := tlsConn.Handshake()
-	if erro != nil {
-		return "crit (checking phase): handshaking with remote: " + erro.Error(), dur
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return checkErr("handshaking with remote", err), dur
 	}
 
 	rq := fmt.Appendf(nil, "GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\nAccept: */*\r\n\r\n", constants.CHKURL, constants.CHKHOST, constants.CHKUSERAGENT)
 	shouldbe := fmt.Appendf(nil, "HTTP/1.1 %d", constants.CHKRESPCODE)
 	buff := make([]byte, 4096)
 
-	_, erro = tlsConn.Write(rq)
-	if erro != nil {
-		return "crit (checking phase): sending request to remote: " + erro.Error(), dur
+	_, err = tlsConn.Write(rq)
+	if err != nil {
+		return checkErr("sending request to remote", err), dur
 	}
 
-	n, erro := tlsConn.Read(buff)
-	if erro != nil {
-		return "crit (checking phase): getting answer from remote: " + erro.Error(), dur
+	n, err := tlsConn.Read(buff)
+	if err != nil {
+		return checkErr("getting answer from remote", err), dur
 	}
 
 	if n < len(shouldbe) || !bytes.HasPrefix(buff, shouldbe) {
-		return "crit (checking phase): didn't get satisfying answer", dur
+		return proxy.NewError(proxy.ErrCheck, "checking phase", "didn't get satisfying answer"), dur
 	}
 
-	return "", dur
+	return nil, dur
+}
+
+var remotes sync.Map // check urls of proxies, resolved once
+
+func remoteFor(rawurl string) (*remote, error) {
+	if r, ok := remotes.Load(rawurl); ok {
+		return r.(*remote), nil
+	}
+	r, err := newRemote(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	remotes.Store(rawurl, r)
+	return r, nil
+}
+
+// checks prx by fetching r through it
+func checkRemote(ctx context.Context, prx *proxy.Proxy, r *remote) (error, time.Duration) {
+	resp, conn, dur, err := r.get(ctx, prx, constants.CHKTO)
+	if err != nil {
+		return err, dur
+	}
+	resp.Body.Close()
+	conn.Close()
+	return nil, dur
+}
+
+// wraps an error that happened after the tunnel was established
+func checkErr(stage string, err error) *proxy.Error {
+	class := proxy.ErrCheck
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		class = proxy.ErrTimeout
+	}
+	return &proxy.Error{Class: class, Stage: "checking phase: " + stage, Err: err}
 }
 
-func checking(rq chan<- chan proxy.Message) {
+// Probes are optional measurements made after a successful check when the manager asks for them
+type Probes struct {
+	BW *BWProbe // nil disables bandwidth probes
+	IP *IPProbe // nil disables exit ip probes
+}
+
+func checking(ctx context.Context, pm *proxy.ProxyManager, probes Probes) {
+	log := pm.Logger()
 	for {
-		c := make(chan proxy.Message)
-		rq <- c
-		prx := (<-c).Prx
-		err, dur := check(prx)
-		c <- proxy.Message{
-			Prx: prx,
-			Err: err,
-			Dur: dur,
+		lease, err := pm.Acquire(ctx, proxy.Criteria{Purpose: proxy.Check})
+		if err != nil {
+			return
+		}
+		prx := lease.Prx
+		err, dur := check(ctx, prx, log)
+		if ctx.Err() != nil {
+			// stopped in the middle, the result says nothing about the proxy
+			lease.Release()
+			return
+		}
+		if err != nil {
+			log.Debug("check failed", "proxy", prx.Address, "protocol", prx.Proto.String(), "class", proxy.ClassOf(err).String(), "error", err)
+		}
+		var tput float64
+		var exitIP string
+		if err == nil && lease.ProbeBW && probes.BW != nil {
+			var berr error
+			tput, berr = probes.BW.measure(ctx, prx)
+			if berr != nil {
+				log.Warn("bandwidth probe failed", "proxy", prx.Address, "protocol", prx.Proto.String(), "error", berr)
+			}
+		}
+		if err == nil && lease.ProbeIP && probes.IP != nil {
+			var ierr error
+			exitIP, ierr = probes.IP.exitIP(ctx, prx)
+			if ierr != nil {
+				log.Warn("exit ip probe failed", "proxy", prx.Address, "protocol", prx.Proto.String(), "error", ierr)
+			}
+		}
+		lease.Report(proxy.Result{
+			Err:    err,
+			Dur:    dur,
+			Tput:   tput,
+			ExitIP: exitIP,
+		})
+		lease.Release()
+		select {
+		case <-time.After(constants.CHKTOBTWNCHKS):
+		case <-ctx.Done():
+			return
 		}
-		time.Sleep(constants.CHKTOBTWNCHKS)
 	}
 }
 
-func StartChecking(nth int, pm *proxy.ProxyManager) {
-	c := make(chan chan proxy.Message)
-	go pm.ServeChecker(c)
-	for range nth {
-		go checking(c)
-		time.Sleep(time.Duration(100) * time.Millisecond)
+// StartChecking spawns nth checking goroutines, they stop when ctx is done.
+// wait blocks until they all have
+func StartChecking(ctx context.Context, nth int, pm *proxy.ProxyManager, probes Probes) (wait func()) {
+	var wg sync.WaitGroup
+	for i := range nth {
+		wg.Go(func() {
+			// spread out the first checks
+			select {
+			case <-time.After(time.Duration(i*100) * time.Millisecond):
+			case <-ctx.Done():
+				return
+			}
+			checking(ctx, pm, probes)
+		})
 	}
+	return wg.Wait
 }
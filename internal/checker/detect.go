@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package checker
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/etidart/proxyflow/internal/connector"
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// protocols in the order they are tried. a tls hello, then an http request make
+// servers of the other protocols hang up at once, and a tls server may answer
+// plain http with an error page
+var detectOrder = []proxy.Protocol{proxy.HTTPS, proxy.HTTP, proxy.SOCKS5, proxy.SOCKS4}
+
+var errNoProto = errors.New("speaks none of https, http, socks5 and socks4")
+
+// Detector gives a proxy.ParseOptions.Detect which probes at most parallel proxies
+// at once until ctx is done
+func Detector(ctx context.Context, parallel int) func([]*proxy.Proxy) []error {
+	return func(proxies []*proxy.Proxy) []error {
+		connTo := *getconnto()
+		errs := make([]error, len(proxies))
+		sem := make(chan struct{}, max(parallel, 1))
+		var wg sync.WaitGroup
+		for i, prx := range proxies {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				continue
+			}
+			wg.Go(func() {
+				defer func() { <-sem }()
+				errs[i] = detect(ctx, prx, connTo)
+			})
+		}
+		wg.Wait()
+		return errs
+	}
+}
+
+// handshakes with prx in each protocol until it answers in one, which becomes its Proto
+func detect(ctx context.Context, prx *proxy.Proxy, connTo connector.ConnectWho) error {
+	for _, proto := range detectOrder {
+		try := *prx
+		try.Proto = proto
+		conn, err, _ := connector.ConnectToPrx(ctx, &try, connTo)
+		if err == nil {
+			conn.Close()
+		}
+		if err == nil || speaks(err) {
+			prx.Proto = proto
+			return nil
+		}
+		switch proxy.ClassOf(err) {
+		case proxy.ErrDial, proxy.ErrCanceled:
+			return err
+		}
+	}
+	return errNoProto
+}
+
+// tells if the proxy understood the handshake which failed with err
+func speaks(err error) bool {
+	switch proxy.ClassOf(err) {
+	case proxy.ErrAuth, proxy.ErrRefused, proxy.ErrTargetUnreach:
+		return true
+	}
+	return false
+}
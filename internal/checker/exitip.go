@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package checker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/etidart/proxyflow/internal/constants"
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// IPProbe describes where to learn proxies' exit ips from. the url must answer
+// with the client's ip in plain text (e.g. https://api.ipify.org)
+type IPProbe struct {
+	remote *remote
+}
+
+// NewIPProbe validates rawurl (http or https) and resolves its host
+func NewIPProbe(rawurl string) (*IPProbe, error) {
+	r, err := newRemote(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &IPProbe{remote: r}, nil
+}
+
+// returns the ip remote sees when connecting through prx
+func (ipp *IPProbe) exitIP(ctx context.Context, prx *proxy.Proxy) (string, error) {
+	resp, conn, _, err := ipp.remote.get(ctx, prx, constants.CHKTO)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", errors.New("answer is not an ip")
+	}
+	return ip.String(), nil
+}
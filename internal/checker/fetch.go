@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package checker
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/connector"
+	"github.com/etidart/proxyflow/internal/constants"
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// remote is an http(s) url which is fetched through proxies
+type remote struct {
+	url     *url.URL
+	connwho connector.ConnectWho
+}
+
+// validates rawurl (http or https) and resolves its host
+func newRemote(rawurl string) (*remote, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("unsupported scheme " + u.Scheme)
+	}
+
+	r := &remote{url: u}
+	port := u.Port()
+	if port == "" {
+		if u.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	r.connwho.Port = uint16(p)
+
+	ipAddresses, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ipAddresses {
+		if ip.To4() != nil {
+			r.connwho.IP = ip.String()
+			break
+		}
+	}
+	if r.connwho.IP == "" {
+		return nil, errors.New("no ipv4 address for " + u.Hostname())
+	}
+	return r, nil
+}
+
+// sends GET through prx and returns the response with a 2xx status and the handshake
+// time. to must cover reading the body too. caller must close the conn, which is also
+// closed when ctx is done
+func (r *remote) get(ctx context.Context, prx *proxy.Proxy, to time.Duration) (*http.Response, net.Conn, time.Duration, error) {
+	conn, err, dur := connector.ConnectToPrx(ctx, prx, r.connwho)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	conn.SetDeadline(time.Now().Add(to))
+	raw := conn
+	conn = &ctxConn{Conn: raw, stop: context.AfterFunc(ctx, func() { raw.Close() })}
+
+	if r.url.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: r.url.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, dur, checkErr("handshaking with remote", err)
+		}
+		conn = tlsConn
+	}
+
+	rq := fmt.Appendf(nil, "GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\nAccept: */*\r\nConnection: close\r\n\r\n",
+		r.url.RequestURI(), r.url.Host, constants.CHKUSERAGENT)
+	if _, err := conn.Write(rq); err != nil {
+		conn.Close()
+		return nil, nil, dur, checkErr("sending request to remote", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, dur, checkErr("getting answer from remote", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		conn.Close()
+		return nil, nil, dur, proxy.NewError(proxy.ErrCheck, "checking phase", "remote answered %s", resp.Status)
+	}
+	return resp, conn, dur, nil
+}
+
+// ctxConn is a conn closed when a context is done, Close also forgets the context
+type ctxConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *ctxConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
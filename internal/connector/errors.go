@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package connector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// classifies an error of reading/writing/dialing: timeouts are ErrTimeout, everything else is class
+func netErr(class proxy.ErrClass, stage string, err error) *proxy.Error {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		class = proxy.ErrTimeout
+	}
+	return &proxy.Error{Class: class, Stage: stage, Err: err}
+}
+
+// classifies a non-success socks5 reply code
+func s5ReplyErr(stage string, code byte) *proxy.Error {
+	switch code {
+	case 0x03, 0x04, 0x05, 0x06: // network unreachable, host unreachable, connection refused, ttl expired
+		return proxy.NewError(proxy.ErrTargetUnreach, stage, "target unreachable (reply %02xh)", code)
+	case 0x07, 0x08: // command or address type not supported
+		return proxy.NewError(proxy.ErrProto, stage, "request not supported (reply %02xh)", code)
+	}
+	return proxy.NewError(proxy.ErrRefused, stage, "answer is not 00h (granted), got %02xh", code)
+}
+
+// reclasses err as ErrCanceled if ctx (the caller's, not the handshake's) was canceled
+func ctxErr(ctx context.Context, err error) error {
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		return err
+	}
+	var perr *proxy.Error
+	if errors.As(err, &perr) {
+		return &proxy.Error{Class: proxy.ErrCanceled, Stage: perr.Stage, Err: perr.Err}
+	}
+	return &proxy.Error{Class: proxy.ErrCanceled, Stage: "handshake", Err: err}
+}
+
+// makes reads and writes on conn fail once ctx is done (as they do on a deadline).
+// the returned func unbinds ctx and tells whether it was done by then
+func bindCtx(ctx context.Context, conn net.Conn) func() bool {
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() bool {
+		return !stop()
+	}
+}
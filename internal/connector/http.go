@@ -13,42 +13,68 @@ package connector
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/etidart/proxyflow/internal/constants"
+	"github.com/etidart/proxyflow/internal/proxy"
 )
 
-func httpHandshake(conn net.Conn, connTo ConnectWho) (net.Conn, string) {
-	tosend := fmt.Sprintf("CONNECT %[1]s:%[2]d HTTP/1.1\r\nHost: %[1]s:%[2]d\r\nUser-Agent: %[3]s\r\nProxy-Connection: Keep-Alive\r\n\r\n",
-		connTo.IP, connTo.Port, constants.CONUSERAGENT)
+// user and pass are sent with basic auth unless user is empty
+func httpHandshake(conn net.Conn, connTo ConnectWho, user string, pass string) (net.Conn, error) {
+	var auth string
+	if user != "" {
+		auth = "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)) + "\r\n"
+	}
+	tosend := fmt.Sprintf("CONNECT %[1]s:%[2]d HTTP/1.1\r\nHost: %[1]s:%[2]d\r\nUser-Agent: %[3]s\r\n%[4]sProxy-Connection: Keep-Alive\r\n\r\n",
+		connTo.IP, connTo.Port, constants.CONUSERAGENT, auth)
 	_, err := conn.Write([]byte(tosend))
 	if err != nil {
 		conn.Close()
-		return nil, "crit: http stage1s: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "http stage1s", err)
 	}
 	buff := make([]byte, 16384)
 	n, err := conn.Read(buff)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: http stage1r: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "http stage1r", err)
+	}
+	// "HTTP/1.x NNN"
+	if n < 12 || !bytes.HasPrefix(buff, []byte("HTTP/1.")) {
+		conn.Close()
+		return nil, proxy.NewError(proxy.ErrProto, "http stage1r", "answer is not http")
+	}
+	code, err := strconv.Atoi(string(buff[9:12]))
+	if err != nil {
+		conn.Close()
+		return nil, proxy.NewError(proxy.ErrProto, "http stage1r", "bad status code")
 	}
-	shouldbe := []byte("HTTP/1.1 200")
-	if n < len(shouldbe) || !bytes.HasPrefix(buff, shouldbe) {
+	switch {
+	case code == 200:
+	case code == 407:
+		conn.Close()
+		return nil, proxy.NewError(proxy.ErrAuth, "http stage1r", "proxy authentication required")
+	case code == 502 || code == 503 || code == 504:
+		conn.Close()
+		return nil, proxy.NewError(proxy.ErrTargetUnreach, "http stage1r", "target unreachable (%d)", code)
+	default:
 		conn.Close()
-		return nil, "http stage1r: answer is not 200 OK"
+		return nil, proxy.NewError(proxy.ErrRefused, "http stage1r", "answer is not 200 OK (%d)", code)
 	}
 	// done -----------------
-	return conn, ""
+	return conn, nil
 }
 
-func httpsHandshake(conn net.Conn, connTo ConnectWho) (net.Conn, string) {
+func httpsHandshake(ctx context.Context, conn net.Conn, connTo ConnectWho, user string, pass string) (net.Conn, error) {
 	tlsConn := tls.Client(conn, getTLSConfig())
-	err := tlsConn.Handshake()
+	err := tlsConn.HandshakeContext(ctx)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: https tls handshake: " + err.Error()
+		return nil, netErr(proxy.ErrTLS, "https tls handshake", err)
 	}
-	return httpHandshake(tlsConn, connTo)
+	return httpHandshake(tlsConn, connTo, user, pass)
 }
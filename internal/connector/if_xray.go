@@ -14,6 +14,7 @@
 package connector
 
 import (
+	"context"
 	"net"
 	"time"
 
@@ -26,39 +27,51 @@ type ConnectWho struct {
 	Port uint16
 }
 
-func ConnectToPrx(prx *proxy.Proxy, connTo ConnectWho) (net.Conn, string, time.Duration) {
+var dialer net.Dialer
+
+// ConnectToPrx connects to connTo through prx. the handshake is aborted when ctx
+// is done or CONCONNHSTO passes, whichever comes first
+func ConnectToPrx(ctx context.Context, prx *proxy.Proxy, connTo ConnectWho) (net.Conn, error, time.Duration) {
 	currTime := time.Now()
+	hsctx, cancel := context.WithTimeout(ctx, constants.CONCONNHSTO)
+	defer cancel()
 	// time is measuring -------------
 	var connection net.Conn
 	var err error
+	unbind := func() bool { return false } // xrayHandshake binds hsctx itself
 	if prx.Proto != proxy.XRAY {
-		connection, err = net.DialTimeout("tcp4", prx.Address, constants.CONCONNHSTO)
+		connection, err = dialer.DialContext(hsctx, "tcp4", prx.Address)
 		if err != nil {
-			return nil, "while connecting: " + err.Error(), 0
+			return nil, ctxErr(ctx, netErr(proxy.ErrDial, "while connecting", err)), 0
 		}
-		connection.SetDeadline(time.Now().Add(constants.CONCONNHSTO))
+		unbind = bindCtx(hsctx, connection)
 	}
 
 	// transfering all the work
 	var rconn net.Conn
-	var rerr string
+	var rerr error
 	switch prx.Proto {
 	case proxy.HTTP:
-		rconn, rerr = httpHandshake(connection, connTo)
+		rconn, rerr = httpHandshake(connection, connTo, prx.User, prx.Pass)
 	case proxy.HTTPS:
-		rconn, rerr = httpsHandshake(connection, connTo)
+		rconn, rerr = httpsHandshake(hsctx, connection, connTo, prx.User, prx.Pass)
 	case proxy.SOCKS4:
-		rconn, rerr = s4Handshake(connection, connTo)
+		rconn, rerr = s4Handshake(connection, connTo, prx.User)
 	case proxy.SOCKS5:
-		rconn, rerr = s5Handshake(connection, connTo)
+		rconn, rerr = s5Handshake(connection, connTo, prx.User, prx.Pass)
 	case proxy.XRAY:
-		rconn, rerr = xrayHandshake(prx.Address, connTo)
+		rconn, rerr = xrayHandshake(hsctx, prx.Address, connTo)
 	}
 	// -------------------------------
-	if rerr == "" {
+	if unbind() && rerr == nil {
+		// done right after the handshake, the conn may be already broken by the deadline
+		rconn.Close()
+		rerr = netErr(proxy.ErrIO, "after handshake", hsctx.Err())
+	}
+	if rerr == nil {
 		rconn.SetDeadline(time.Time{}) // no more deadlines
 		hsMeasure := time.Since(currTime)
-		return rconn, "", hsMeasure
+		return rconn, nil, hsMeasure
 	}
-	return nil, rerr, 0
+	return nil, ctxErr(ctx, rerr), 0
 }
@@ -12,55 +12,103 @@
 package connector
 
 import (
-	"bytes"
 	"encoding/binary"
 	"net"
+
+	"github.com/etidart/proxyflow/internal/proxy"
 )
 
-func s4Handshake(conn net.Conn, connTo ConnectWho) (net.Conn, string) {
+// userid goes to the request as is, socks4 has no passwords
+func s4Handshake(conn net.Conn, connTo ConnectWho, userid string) (net.Conn, error) {
 	rip := net.ParseIP(connTo.IP).To4()
-	request := make([]byte, 0, 9)
+	request := make([]byte, 0, 9+len(userid))
 	request = append(request, 0x04, 0x01)
 	request = binary.BigEndian.AppendUint16(request, connTo.Port)
 	request = append(request, rip...)
+	request = append(request, userid...)
 	request = append(request, 0x00)
 
 	_, err := conn.Write(request)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: s4 stage1s: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "s4 stage1s", err)
 	}
 	buff := make([]byte, 16384)
-	_, err = conn.Read(buff)
+	n, err := conn.Read(buff)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: s4 stage1r: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "s4 stage1r", err)
 	}
-	if !bytes.HasPrefix(buff, []byte{0x00, 0x5a}) {
+	if n < 2 || buff[0] != 0x00 {
 		conn.Close()
-		return nil, "s4 stage1r: answer is not 5ah (granted)"
+		return nil, proxy.NewError(proxy.ErrProto, "s4 stage1r", "answer is not socks4")
+	}
+	switch buff[1] {
+	case 0x5a:
+	case 0x5c, 0x5d: // identd is unreachable or disagrees
+		conn.Close()
+		return nil, proxy.NewError(proxy.ErrAuth, "s4 stage1r", "identd rejected the request (%02xh)", buff[1])
+	default:
+		// 5bh is both "rejected" and "failed", there is no way to tell which one
+		conn.Close()
+		return nil, proxy.NewError(proxy.ErrRefused, "s4 stage1r", "answer is not 5ah (granted), got %02xh", buff[1])
 	}
 	// done -----------------
-	return conn, ""
+	return conn, nil
 }
 
-func s5Handshake(conn net.Conn, connTo ConnectWho) (net.Conn, string) {
+// username/password auth (rfc 1929) is offered unless user is empty
+func s5Handshake(conn net.Conn, connTo ConnectWho, user string, pass string) (net.Conn, error) {
 	//stage 1
 	s1rq := []byte{0x05, 0x01, 0x00}
+	if user != "" {
+		s1rq = []byte{0x05, 0x02, 0x00, 0x02}
+	}
 	_, err := conn.Write(s1rq)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: s5 stage1s: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "s5 stage1s", err)
 	}
 	buff := make([]byte, 16384)
-	_, err = conn.Read(buff)
+	n, err := conn.Read(buff)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: s5 stage1r: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "s5 stage1r", err)
 	}
-	if !bytes.HasPrefix(buff, []byte{0x05, 0x00}) {
+	if n < 2 || buff[0] != 0x05 {
 		conn.Close()
-		return nil, "crit: s5 stage1r: auth is not accepted"
+		return nil, proxy.NewError(proxy.ErrProto, "s5 stage1r", "answer is not socks5")
+	}
+	switch {
+	case buff[1] == 0x00:
+	case buff[1] == 0x02 && user != "":
+		//stage 1_auth
+		if len(user) > 255 || len(pass) > 255 {
+			conn.Close()
+			return nil, proxy.NewError(proxy.ErrAuth, "s5 stage1as", "credentials are too long")
+		}
+		s1arq := make([]byte, 0, 3+len(user)+len(pass))
+		s1arq = append(s1arq, 0x01, byte(len(user)))
+		s1arq = append(s1arq, user...)
+		s1arq = append(s1arq, byte(len(pass)))
+		s1arq = append(s1arq, pass...)
+		_, err = conn.Write(s1arq)
+		if err != nil {
+			conn.Close()
+			return nil, netErr(proxy.ErrIO, "s5 stage1as", err)
+		}
+		n, err = conn.Read(buff)
+		if err != nil {
+			conn.Close()
+			return nil, netErr(proxy.ErrIO, "s5 stage1ar", err)
+		}
+		if n < 2 || buff[1] != 0x00 {
+			conn.Close()
+			return nil, proxy.NewError(proxy.ErrAuth, "s5 stage1ar", "credentials are not accepted")
+		}
+	default:
+		conn.Close()
+		return nil, proxy.NewError(proxy.ErrAuth, "s5 stage1r", "auth is not accepted")
 	}
 	//stage 2
 	s2rq := make([]byte, 0, 10)
@@ -71,17 +119,21 @@ func s5Handshake(conn net.Conn, connTo ConnectWho) (net.Conn, string) {
 	_, err = conn.Write(s2rq)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: s5 stage2s: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "s5 stage2s", err)
 	}
-	_, err = conn.Read(buff)
+	n, err = conn.Read(buff)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: s5 stage2r: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "s5 stage2r", err)
+	}
+	if n < 3 || buff[0] != 0x05 {
+		conn.Close()
+		return nil, proxy.NewError(proxy.ErrProto, "s5 stage2r", "answer is not socks5")
 	}
-	if !bytes.HasPrefix(buff, []byte{0x05, 0x00, 0x00}) {
+	if buff[1] != 0x00 {
 		conn.Close()
-		return nil, "s5 stage2r: answer is not 00h (granted)"
+		return nil, s5ReplyErr("s5 stage2r", buff[1])
 	}
 	// done -----------------
-	return conn, ""
+	return conn, nil
 }
@@ -15,35 +15,39 @@ package connector
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
 	"strings"
+
+	"github.com/etidart/proxyflow/internal/proxy"
 )
 
-func xrayHandshake(address string, connTo ConnectWho) (net.Conn, string) {
+func xrayHandshake(ctx context.Context, address string, connTo ConnectWho) (net.Conn, error) {
 	xray_port, username, _ := strings.Cut(address, ":")
-	conn, err := net.Dial("tcp4", "127.0.0.1:"+fmt.Sprint(xray_port))
+	conn, err := dialer.DialContext(ctx, "tcp4", "127.0.0.1:"+fmt.Sprint(xray_port))
 	if err != nil {
-		panic(err)
+		return nil, netErr(proxy.ErrDial, "xray connecting", err)
 	}
+	defer bindCtx(ctx, conn)()
 
 	//stage 1
 	s1rq := []byte{0x05, 0x01, 0x02}
 	_, err = conn.Write(s1rq)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: xray stage1s: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "xray stage1s", err)
 	}
 	buff := make([]byte, 16384)
 	_, err = conn.Read(buff)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: xray stage1r: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "xray stage1r", err)
 	}
 	if !bytes.HasPrefix(buff, []byte{0x05, 0x02}) {
 		conn.Close()
-		return nil, "crit: xray stage1r: auth is not accepted"
+		return nil, proxy.NewError(proxy.ErrAuth, "xray stage1r", "auth is not accepted")
 	}
 	//stage 1_auth
 	s1arq := make([]byte, 0, 4+len(username))
@@ -54,16 +58,16 @@ func xrayHandshake(address string, connTo ConnectWho) (net.Conn, string) {
 	_, err = conn.Write(s1arq)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: xray stage1as: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "xray stage1as", err)
 	}
 	_, err = conn.Read(buff)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: xray stage1ar: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "xray stage1ar", err)
 	}
 	if !bytes.HasPrefix(buff, []byte{0x01, 0x00}) {
 		conn.Close()
-		return nil, "crit: xray stage1r: auth is not accepted"
+		return nil, proxy.NewError(proxy.ErrAuth, "xray stage1ar", "auth is not accepted")
 	}
 	//stage 2
 	s2rq := make([]byte, 0, 10)
@@ -74,17 +78,21 @@ func xrayHandshake(address string, connTo ConnectWho) (net.Conn, string) {
 	_, err = conn.Write(s2rq)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: xray stage2s: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "xray stage2s", err)
 	}
-	_, err = conn.Read(buff)
+	n, err := conn.Read(buff)
 	if err != nil {
 		conn.Close()
-		return nil, "crit: xray stage2r: " + err.Error()
+		return nil, netErr(proxy.ErrIO, "xray stage2r", err)
+	}
+	if n < 3 || buff[0] != 0x05 {
+		conn.Close()
+		return nil, proxy.NewError(proxy.ErrProto, "xray stage2r", "answer is not socks5")
 	}
-	if !bytes.HasPrefix(buff, []byte{0x05, 0x00, 0x00}) {
+	if buff[1] != 0x00 {
 		conn.Close()
-		return nil, "xray stage2r: answer is not 00h (granted)"
+		return nil, s5ReplyErr("xray stage2r", buff[1])
 	}
 	// done -----------------
-	return conn, ""
+	return conn, nil
 }
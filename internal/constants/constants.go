@@ -21,6 +21,7 @@ const (
 	CHKRESPCODE   = 204                                                                                                               // response code: ..., what response code should be considered good
 	CHKTO         = time.Duration(1) * time.Second                                                                                    // timeout: ..., how much time is acceptable for TLS handshake with host, sending request and getting response. NOT COVERING CONNECTION TO PROXY (AND CONNECTION FROM PROXY TO HOST)
 	CHKTOBTWNCHKS = time.Duration(2) * time.Second                                                                                    // timeout between checks: how much time should pass after each check ended before a new check started in each goroutine separately. it is only needed to not overload network by too many requestes.
+	CHKBWTO       = time.Duration(15) * time.Second                                                                                   // bandwidth timeout: how much time is acceptable for the whole bandwidth probe (request + downloading the body). NOT COVERING CONNECTION TO PROXY
 )
 // /checker
 
@@ -33,16 +34,50 @@ const (
 
 // proxy/
 const (
-	PRXMAXERRS      = 2                                          // max errors: how many errors can proxy get before sending to badProxies
-	PRXCHKCD        = time.Duration(1) * time.Second             // check cooldown: how much time should pass before each proxy separately can be checked again. it is only needed to not overload single proxy which can be loaded by user requests meanwhile
-	PRXDEFHSAVG     = CONCONNHSTO + time.Duration(1)*time.Second // default handshake average: when new proxy is added, what should be its handshakeAvg value. must be greater than CONCONNHSTO for optimized working
-	PRXMINHSAVGDIFF = time.Duration(500) * time.Millisecond      // min handshakeAvg difference: on what minimal difference handshakeAvg should be updated
+	PRXBRKWINDOW     = 20                                         // breaker window: default number of last outcomes (successes and failures) each proxy's circuit breaker keeps
+	PRXBRKMINSAMPLES = 5                                          // breaker min samples: default number of outcomes which must be in the window before the breaker can trip
+	PRXBRKFAILRATE   = 0.5                                        // breaker failure rate: default failure rate (sum of penalties / outcomes in the window) which trips the breaker and sends proxy to badProxies
+	PRXCHKCD         = time.Duration(1) * time.Second             // check cooldown: how much time should pass before each proxy separately can be checked again. it is only needed to not overload single proxy which can be loaded by user requests meanwhile
+	PRXBRKCD         = time.Duration(30) * time.Second            // breaker cooldown: default time an open breaker waits before letting trial traffic through (half-open). doubles after each failed trial
+	PRXBRKMAXCD      = time.Duration(30) * time.Minute            // max breaker cooldown: upper limit of the doubling cooldown
+	PRXBRKTRIALS     = 2                                          // breaker trials: how many trials (checks or user requests) can be in flight through a half-open proxy
+	PRXBRKTRIALTO    = time.Duration(30) * time.Second            // breaker trial timeout: after how much time an unanswered trial is considered lost
+	PRXPROMOTESUCC   = 3                                          // promote successes: default number of consecutive successful trials after which a breaker closes and proxy is taken back from badProxies
+	PRXMAXDEAD       = time.Duration(24) * time.Hour              // max dead: default time a proxy can stay in badProxies before it is dropped for good
+	PRXDEFHSAVG      = CONCONNHSTO + time.Duration(1)*time.Second // default handshake average: when new proxy is added, what should be its latency estimate until the first sample. must be greater than CONCONNHSTO for optimized working
+	PRXEWMAALPHA     = 0.3                                        // ewma alpha: default weight of a new sample in the latency and throughput estimates (0..1, bigger reacts faster)
+	PRXLOGTOP        = 5                                          // log top: how many best proxies are listed by the periodic stats log
+	PRXLATWINDOW     = 64                                         // latency window: how many last handshake samples are kept for percentiles
+	PRXBWREFSIZE     = 1 << 20                                    // bandwidth reference size: ranking estimates how long it would take to download this many bytes through a proxy (latency + size/throughput)
 )
 // /proxy
 
 // server/
 const (
-	SRVMAXRETRIES = 3                                     // max retries: how many times can server retry to get a working proxy
-	SRVRETRYCD    = time.Duration(500) * time.Millisecond // retry cooldown: how much time should pass before retrying again to get a working proxy
+	SRVMAXRETRIES   = 3                                     // max retries: how many times can server retry to get a working proxy
+	SRVRETRYCD      = time.Duration(500) * time.Millisecond // retry cooldown: how much time should pass before retrying again to get a working proxy
+	SRVTPUTMINBYTES = 256 << 10                             // throughput min bytes: how many bytes should be downloaded through a proxy in one session before its throughput is reported to the manager
+	SRVTPUTMAXGAP   = time.Duration(1) * time.Second        // throughput max gap: pauses between reads longer than this are not counted as transfer time (client is most likely idle)
+	SRVGRACE        = time.Duration(30) * time.Second       // grace period: how long active relays are waited for on shutdown before they are closed
+	SRVIDLETO       = time.Duration(5) * time.Minute        // idle timeout: how long a relay can go without any data moving in either direction before it is closed
+	SRVCLIHSTO      = time.Duration(10) * time.Second       // client handshake timeout: how long a client can take to authenticate and send its request before the connection is closed
+	SRVACLRELOAD    = time.Duration(10) * time.Second       // acl reload: how often the acl file is checked for changes
+	SRVQUOTAPERIOD  = time.Duration(24) * time.Hour         // quota period: how often users' byte quotas are renewed
+	SRVREFUSETO     = time.Duration(3) * time.Second        // refuse timeout: how long a client which is over the limits is given to send its request so that it gets a "not allowed" reply
+	SRVMAXREFUSING  = 64                                    // max refusing: how many clients over the limits can be waited for at once to be replied to, the ones over that are just disconnected
 )
 // /server
+
+// limiter/
+const (
+	LIMSWEEP = time.Duration(1) * time.Minute // sweep interval: how often per-key token buckets which are full (unused) are forgotten
+)
+// /limiter
+
+// source/
+const (
+	SRCFETCHTO = time.Duration(1) * time.Minute // fetch timeout: how long fetching a proxy list from a source (download or command run) can take
+	SRCMAXSIZE = 64 << 20                       // max size: how many bytes of a downloaded proxy list are read at most
+	SRCDETECTN = 50                             // detection threads: how many endpoints without a scheme are probed at once for the protocol they speak
+)
+// /source
@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package limiter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+)
+
+// Bucket is a token bucket: it holds up to burst tokens and gains rate tokens per second
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket makes a full bucket
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Allow takes a token if there is one
+func (b *Bucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Take takes n tokens, going into debt if there are not enough of them,
+// and returns how long to wait until the debt is paid off
+func (b *Bucket) Take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// tells if the bucket is full, so it can be forgotten
+func (b *Bucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.tokens >= b.burst
+}
+
+// Buckets keeps a bucket per key (e.g. client ip). a nil *Buckets allows everything
+type Buckets struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	m         map[string]*heldBucket
+	lastSweep time.Time
+}
+
+// a bucket with the number of its holders, held buckets are never swept
+type heldBucket struct {
+	*Bucket
+	holders int
+}
+
+// NewBuckets makes per-key buckets, each one like NewBucket(rate, burst)
+func NewBuckets(rate float64, burst int) *Buckets {
+	return &Buckets{rate: rate, burst: burst, m: make(map[string]*heldBucket), lastSweep: time.Now()}
+}
+
+// Allow takes a token from key's bucket if there is one
+func (bs *Buckets) Allow(key string) bool {
+	if bs == nil {
+		return true
+	}
+	return bs.Get(key).Allow()
+}
+
+// Get returns key's bucket, nil if bs is nil. the bucket may be forgotten once it is
+// full, use Acquire to keep it for longer
+func (bs *Buckets) Get(key string) *Bucket {
+	if bs == nil {
+		return nil
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.get(key).Bucket
+}
+
+// Acquire returns key's bucket (nil if bs is nil) and keeps it until Release is called
+// as many times, so everyone using key at once shares one bucket
+func (bs *Buckets) Acquire(key string) *Bucket {
+	if bs == nil {
+		return nil
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b := bs.get(key)
+	b.holders++
+	return b.Bucket
+}
+
+// Release gives back a bucket acquired before
+func (bs *Buckets) Release(key string) {
+	if bs == nil {
+		return
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if b, ok := bs.m[key]; ok && b.holders > 0 {
+		b.holders--
+	}
+}
+
+// bs.mu must be held
+func (bs *Buckets) get(key string) *heldBucket {
+	if time.Since(bs.lastSweep) > constants.LIMSWEEP {
+		// full buckets nobody holds are the same as new ones
+		for k, b := range bs.m {
+			if b.holders == 0 && b.full() {
+				delete(bs.m, k)
+			}
+		}
+		bs.lastSweep = time.Now()
+	}
+	b, ok := bs.m[key]
+	if !ok {
+		b = &heldBucket{Bucket: NewBucket(bs.rate, bs.burst)}
+		bs.m[key] = b
+	}
+	return b
+}
+
+// Counter limits how many holders each key can have at once. a nil *Counter allows everything
+type Counter struct {
+	mu  sync.Mutex
+	max int
+	m   map[string]int
+}
+
+// NewCounter makes a counter allowing max holders per key
+func NewCounter(max int) *Counter {
+	return &Counter{max: max, m: make(map[string]int)}
+}
+
+// Acquire adds a holder to key unless it has max of them already
+func (c *Counter) Acquire(key string) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m[key] >= c.max {
+		return false
+	}
+	c.m[key]++
+	return true
+}
+
+// Release removes a holder acquired before
+func (c *Counter) Release(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m[key] <= 1 {
+		delete(c.m, key)
+		return
+	}
+	c.m[key]--
+}
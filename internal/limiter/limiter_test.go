@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+)
+
+func TestBucketAllow(t *testing.T) {
+	b := NewBucket(1, 3)
+	for i := range 3 {
+		if !b.Allow() {
+			t.Fatalf("token %d of the burst is not allowed", i)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("a token over the burst is allowed")
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	tests := []struct {
+		name  string
+		burst int
+		take  []int
+		wait  time.Duration // after the last take, roughly
+	}{
+		{"within the burst", 100, []int{40, 60}, 0},
+		{"into debt", 100, []int{150}, 500 * time.Millisecond},
+		{"debt grows", 100, []int{100, 100}, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBucket(100, tt.burst)
+			var wait time.Duration
+			for _, n := range tt.take {
+				wait = b.Take(n)
+			}
+			if d := wait - tt.wait; d < -50*time.Millisecond || d > 50*time.Millisecond {
+				t.Errorf("waits %v, want about %v", wait, tt.wait)
+			}
+		})
+	}
+}
+
+func TestNilLimiters(t *testing.T) {
+	var bs *Buckets
+	if !bs.Allow("a") || bs.Get("a") != nil || bs.Acquire("a") != nil {
+		t.Error("nil buckets limit something")
+	}
+	bs.Release("a")
+	var c *Counter
+	if !c.Acquire("a") {
+		t.Error("nil counter limits something")
+	}
+	c.Release("a")
+}
+
+// buckets held by someone survive sweeps, so holders of a key keep sharing one
+func TestBucketsSweep(t *testing.T) {
+	bs := NewBuckets(1000, 10)
+	held := bs.Acquire("held")
+	free := bs.Get("free")
+	bs.lastSweep = time.Now().Add(-2 * constants.LIMSWEEP)
+
+	if got := bs.Get("held"); got != held {
+		t.Error("a held bucket is swept")
+	}
+	if got := bs.Get("free"); got == free {
+		t.Error("a full bucket nobody holds is kept")
+	}
+
+	bs.Release("held")
+	bs.lastSweep = time.Now().Add(-2 * constants.LIMSWEEP)
+	if got := bs.Get("held"); got == held {
+		t.Error("a released full bucket is kept")
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter(2)
+	if !c.Acquire("a") || !c.Acquire("a") {
+		t.Fatal("holders under the max are refused")
+	}
+	if c.Acquire("a") {
+		t.Fatal("a holder over the max is allowed")
+	}
+	if !c.Acquire("b") {
+		t.Fatal("keys share their holders")
+	}
+	c.Release("a")
+	if !c.Acquire("a") {
+		t.Fatal("a released holder is still counted")
+	}
+}
@@ -12,25 +12,114 @@
 package logging
 
 import (
-	"log"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
+	"sync/atomic"
 )
 
-var logger *log.Logger
+// LevelFatal is logged right before the program exits
+const LevelFatal = slog.LevelError + 4
 
-func Init() {
-	logger = log.New(os.Stdout, "", log.LstdFlags)
+// Config tells where and how to log
+type Config struct {
+	Level      slog.Level
+	JSON       bool   // json lines instead of key=value text
+	File       string // empty means stdout (or stderr)
+	Stderr     bool   // log to stderr instead of stdout when File is empty
+	MaxSize    int64  // rotate File when it grows bigger than this many bytes, 0 disables rotation
+	MaxBackups int    // how many rotated files (File.1, File.2, ...) to keep
 }
 
-func Info(msg string) {
-	logger.Println("INFO", msg)
+var logger atomic.Pointer[slog.Logger]
+
+func init() {
+	logger.Store(newLogger(os.Stdout, Config{Level: slog.LevelInfo}))
+}
+
+// Init sets up logging according to cfg. until it is called, everything at
+// INFO and above is logged to stdout as text
+func Init(cfg Config) error {
+	var w io.Writer = os.Stdout
+	if cfg.Stderr {
+		w = os.Stderr
+	}
+	if cfg.File != "" {
+		rw, err := newRotatingWriter(cfg.File, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return err
+		}
+		w = rw
+	}
+	logger.Store(newLogger(w, cfg))
+	return nil
+}
+
+// Logger returns the logger the package functions log to
+func Logger() *slog.Logger {
+	return logger.Load()
+}
+
+func newLogger(w io.Writer, cfg Config) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level: cfg.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 {
+				if lvl, ok := a.Value.Any().(slog.Level); ok && lvl == LevelFatal {
+					a.Value = slog.StringValue("FATAL")
+				}
+			}
+			return a
+		},
+	}
+	if cfg.JSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(s)); err != nil {
+		return lvl, errors.New("unknown log level " + s)
+	}
+	return lvl, nil
+}
+
+// ParseFormat parses text or json, reporting whether it is json
+func ParseFormat(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return false, nil
+	case "json":
+		return true, nil
+	}
+	return false, errors.New("unknown log format " + s)
+}
+
+// Enabled reports whether messages of lvl are logged
+func Enabled(lvl slog.Level) bool {
+	return logger.Load().Enabled(context.Background(), lvl)
+}
+
+// args are key-value pairs or slog.Attr, as in log/slog
+func Debug(msg string, args ...any) {
+	logger.Load().Debug(msg, args...)
+}
+func Info(msg string, args ...any) {
+	logger.Load().Info(msg, args...)
 }
-func Warn(msg string) {
-	logger.Println("WARN", msg)
+func Warn(msg string, args ...any) {
+	logger.Load().Warn(msg, args...)
 }
-func Error(msg string) {
-	logger.Println("ERROR", msg)
+func Error(msg string, args ...any) {
+	logger.Load().Error(msg, args...)
 }
-func Fatal(msg string) {
-	logger.Fatalln("FATAL", msg)
+func Fatal(msg string, args ...any) {
+	logger.Load().Log(context.Background(), LevelFatal, msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// rotatingWriter appends to a file and, when it grows over maxSize, renames
+// it to file.1 (shifting older ones up to file.<maxBackups>) and starts a new one
+type rotatingWriter struct {
+	mu         sync.Mutex
+	name       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewRotatingWriter opens name for appending, rotating it as described above.
+// maxSize 0 disables rotation
+func NewRotatingWriter(name string, maxSize int64, maxBackups int) (io.Writer, error) {
+	return newRotatingWriter(name, maxSize, maxBackups)
+}
+
+func newRotatingWriter(name string, maxSize int64, maxBackups int) (*rotatingWriter, error) {
+	rw := &rotatingWriter{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rw.open(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *rotatingWriter) open() error {
+	f, err := os.OpenFile(rw.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rw.file = f
+	rw.size = info.Size()
+	return nil
+}
+
+func (rw *rotatingWriter) rotate() error {
+	rw.file.Close()
+	if rw.maxBackups > 0 {
+		for i := rw.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rw.name, i), fmt.Sprintf("%s.%d", rw.name, i+1))
+		}
+		os.Rename(rw.name, rw.name+".1")
+	} else {
+		os.Remove(rw.name)
+	}
+	return rw.open()
+}
+
+func (rw *rotatingWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.maxSize > 0 && rw.size > 0 && rw.size+int64(len(p)) > rw.maxSize {
+		if err := rw.rotate(); err != nil {
+			// nowhere to log it, so at least tell stderr
+			fmt.Fprintln(os.Stderr, "logging: rotating "+rw.name+": "+err.Error())
+			return 0, err
+		}
+	}
+	n, err := rw.file.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
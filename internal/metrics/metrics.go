@@ -0,0 +1,322 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/etidart/proxyflow/internal/logging"
+)
+
+// collector is anything that can write itself in prometheus text format
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	regMu    sync.Mutex
+	registry []collector
+)
+
+func register(c collector) {
+	regMu.Lock()
+	defer regMu.Unlock()
+	registry = append(registry, c)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+}
+
+// formats {l1="v1",l2="v2"} with extra appended after the labels
+func (d *desc) labelString(values []string, extra string) string {
+	if len(d.labels) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range d.labels {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l)
+		b.WriteString(`="`)
+		b.WriteString(escape(values[i]))
+		b.WriteByte('"')
+	}
+	if extra != "" {
+		if len(d.labels) != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec keeps one value of type T per combination of label values
+type vec[T any] struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*T
+	values map[string][]string
+	init   func() *T
+}
+
+func (v *vec[T]) get(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.name + ": wrong number of label values")
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = v.init()
+		v.series[key] = s
+		v.values[key] = slices.Clone(values)
+	}
+	return s
+}
+
+// Delete forgets the series with label values, e.g. of something which is gone
+func (v *vec[T]) Delete(values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key := strings.Join(values, "\xff")
+	delete(v.series, key)
+	delete(v.values, key)
+}
+
+// calls f for every series ordered by label values
+func (v *vec[T]) each(f func(values []string, s *T)) {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		f(v.values[k], v.series[k])
+	}
+}
+
+func (v *vec[T]) setup(name, help, typ string, labels []string, init func() *T) {
+	v.desc = desc{name: name, help: help, typ: typ, labels: labels}
+	v.series = make(map[string]*T)
+	v.values = make(map[string][]string)
+	v.init = init
+	if len(labels) == 0 {
+		// the only series exists from the start, so it is exported as 0 until touched
+		v.get(nil)
+	}
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	vec[float64]
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{}
+	c.setup(name, help, "counter", labels, func() *float64 { return new(float64) })
+	register(c)
+	return c
+}
+
+func (c *Counter) Add(delta float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.get(values) += delta
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	c.each(func(values []string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(values, ""), formatFloat(*v))
+	})
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	vec[float64]
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{}
+	g.setup(name, help, "gauge", labels, func() *float64 { return new(float64) })
+	register(g)
+	return g
+}
+
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.get(values) += delta
+}
+
+func (g *Gauge) Set(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.get(values) = v
+}
+
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(w)
+	g.each(func(values []string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(values, ""), formatFloat(*v))
+	})
+}
+
+// GaugeFunc is a gauge whose values are computed on every scrape
+type GaugeFunc struct {
+	desc
+	f func() map[string]float64 // label value -> value. with no labels the key is ""
+}
+
+// NewGaugeFunc registers a gauge with at most one label, f is called on every scrape
+func NewGaugeFunc(name, help string, label string, f func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name: name, help: help, typ: "gauge"}, f: f}
+	if label != "" {
+		g.labels = []string{label}
+	}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	vals := g.f()
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	g.header(w)
+	for _, k := range keys {
+		var ls string
+		if len(g.labels) != 0 {
+			ls = g.labelString([]string{k}, "")
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.name, ls, formatFloat(vals[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	vec[histogram]
+	buckets []float64
+}
+
+// NewHistogram registers a histogram with upper bounds buckets (sorted ascending, +Inf is implied)
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{buckets: buckets}
+	h.setup(name, help, "histogram", labels, func() *histogram {
+		return &histogram{counts: make([]uint64, len(buckets)+1)}
+	})
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(values)
+	i, _ := slices.BinarySearch(h.buckets, v)
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	h.each(func(values []string, s *histogram) {
+		var cum uint64
+		for i, c := range s.counts {
+			cum += c
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(values, `le="`+formatFloat(le)+`"`), cum)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(values, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(values, ""), s.count)
+	})
+}
+
+// WriteAll writes all registered metrics in prometheus text format
+func WriteAll(w io.Writer) {
+	regMu.Lock()
+	defer regMu.Unlock()
+	for _, c := range registry {
+		c.write(w)
+	}
+}
+
+// ListenAndServe serves /metrics on listenon
+func ListenAndServe(listenon string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteAll(w)
+	})
+	logging.Info("serving metrics", "listen", listenon)
+	if err := http.ListenAndServe(listenon, mux); err != nil {
+		logging.Fatal("metrics listener failed", "listen", listenon, "error", err)
+	}
+}
@@ -0,0 +1,32 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package metrics
+
+// buckets for durations of handshakes (seconds)
+var hsBuckets = []float64{0.05, 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 3, 5}
+
+var (
+	ClientConns = NewGauge("proxyflow_client_connections",
+		"Client connections being served right now.")
+	RelayedBytes = NewCounter("proxyflow_relayed_bytes_total",
+		"Bytes relayed between clients and proxies, up is from clients.", "direction")
+	Handshakes = NewHistogram("proxyflow_handshake_seconds",
+		"Time of connecting to a proxy and asking it for a target.", hsBuckets, "proxy", "protocol")
+	Checks = NewCounter("proxyflow_checks_total",
+		"Checks of proxies by outcome (ok or error class).", "outcome")
+	PoolFallbacks = NewCounter("proxyflow_pool_fallbacks_total",
+		"Requests for a proxy made while there were no healthy proxies with spare capacity, by result (half_open trial, saturated or none).", "result")
+	ServerRetries = NewCounter("proxyflow_server_retries_total",
+		"Retries of getting a working proxy for a client request.")
+	ServerFailures = NewCounter("proxyflow_server_failures_total",
+		"Client requests which weren't served, by reason.", "reason")
+)
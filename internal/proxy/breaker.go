@@ -0,0 +1,265 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+)
+
+type breakerState uint8
+
+const (
+	closed   breakerState = iota // proxy is in proxies and is used normally
+	open                         // proxy is in badProxies and is not used until cooldown passes
+	halfOpen                     // proxy is in badProxies and gets limited trial traffic
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case closed:
+		return "closed"
+	case open:
+		return "open"
+	case halfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// breaker is a per-proxy circuit breaker. while closed it keeps a sliding
+// window of outcomes (0 is a success, otherwise the error's penalty); when
+// the failure rate gets too high it opens for a cooldown which doubles after
+// every failed trial
+type breaker struct {
+	state  breakerState
+	window []uint8
+	next   int
+
+	openedAt  time.Time // when it left closed state
+	until     time.Time // when the cooldown ends
+	cooldown  time.Duration
+	trials    uint8 // trials in flight while half-open
+	lastTrial time.Time
+	successes uint8 // consecutive successful trials
+}
+
+// adds an outcome to the window of size size
+func (b *breaker) record(weight uint8, size int) {
+	if len(b.window) < size {
+		b.window = append(b.window, weight)
+	} else {
+		b.window[b.next] = weight
+		b.next = (b.next + 1) % len(b.window)
+	}
+}
+
+// returns sum of penalties divided by number of outcomes, capped at 1
+func (b *breaker) failRate() float64 {
+	if len(b.window) == 0 {
+		return 0
+	}
+	var sum int
+	for _, w := range b.window {
+		sum += int(w)
+	}
+	return min(float64(sum)/float64(len(b.window)), 1)
+}
+
+// opens the breaker. cooldown is the initial one, it doubles if the breaker wasn't closed
+func (b *breaker) trip(now time.Time, cooldown time.Duration) {
+	if b.state == closed {
+		b.openedAt = now
+		b.cooldown = cooldown
+	} else {
+		b.cooldown = min(b.cooldown*2, constants.PRXBRKMAXCD)
+	}
+	b.state = open
+	b.until = now.Add(b.cooldown)
+	b.trials = 0
+	b.successes = 0
+}
+
+// closes the breaker and forgets the history
+func (b *breaker) reset() {
+	*b = breaker{}
+}
+
+// reports whether a trial may be made now (moving open to half-open when the cooldown is over)
+func (b *breaker) trialAllowed(now time.Time) bool {
+	switch b.state {
+	case open:
+		if now.Before(b.until) {
+			return false
+		}
+		b.state = halfOpen
+		b.trials = 0
+		return true
+	case halfOpen:
+		// trials which weren't answered in time are considered lost
+		return b.trials < constants.PRXBRKTRIALS || now.Sub(b.lastTrial) > constants.PRXBRKTRIALTO
+	}
+	return false
+}
+
+// SetBreaker configures circuit breakers: window is how many last outcomes are
+// kept, a proxy is cut off when at least minSamples of them are there and the
+// failure rate reaches failRate, the first cooldown lasts cooldown
+func (pm *ProxyManager) SetBreaker(window, minSamples int, failRate float64, cooldown time.Duration) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	pm.brkWindow = max(window, 1)
+	pm.brkMinSamples = min(max(minSamples, 1), pm.brkWindow)
+	pm.brkFailRate = failRate
+	pm.brkCooldown = cooldown
+}
+
+// SetProbing configures recovery of bad proxies: promote is how many
+// consecutive successful trials close the breaker, maxDead is how long a
+// proxy may stay bad before it is dropped for good (0 keeps it forever)
+func (pm *ProxyManager) SetProbing(promote uint8, maxDead time.Duration) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	pm.promoteAfter = max(promote, 1)
+	pm.maxDead = maxDead
+}
+
+// records an outcome of a closed proxy and trips its breaker if needed. must be called with lock held
+func (pm *ProxyManager) recordOutcome(prx *Proxy, stats proxyStats, weight uint8) {
+	stats.brk.record(weight, pm.brkWindow)
+	if len(stats.brk.window) < pm.brkMinSamples || stats.brk.failRate() < pm.brkFailRate {
+		pm.proxies[prx] = stats
+		return
+	}
+
+	rate := stats.brk.failRate()
+	delete(pm.proxies, prx)
+	pm.rmFromSorted(prx)
+	stats.brk.trip(time.Now(), pm.brkCooldown)
+	pm.badProxies[prx] = stats
+	pm.Logger().Warn("proxy is cut off", "proxy", prx.Address, "protocol", prx.Proto.String(), "cooldown", stats.brk.cooldown,
+		"fail_rate", rate, "last_error", stats.lastErr, "latency", stats.latency.ewma, "p50", stats.latency.percentile(0.50),
+		"p95", stats.latency.percentile(0.95), "samples", stats.latency.samples)
+}
+
+// takes a trial slot of a bad proxy. must be called with lock held
+func (pm *ProxyManager) takeTrial(prx *Proxy, now time.Time) bool {
+	stats, exists := pm.badProxies[prx]
+	if !exists || !stats.brk.trialAllowed(now) {
+		return false
+	}
+	if now.Sub(stats.brk.lastTrial) > constants.PRXBRKTRIALTO {
+		stats.brk.trials = 0
+	}
+	stats.brk.trials++
+	stats.brk.lastTrial = now
+	pm.badProxies[prx] = stats
+	return true
+}
+
+// gives back a trial slot of a lease which ended without a result (e.g. its
+// handshake was cancelled), so that the proxy doesn't wait PRXBRKTRIALTO for it
+func (pm *ProxyManager) freeTrial(prx *Proxy) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	if prx = pm.resolve(prx); prx == nil {
+		return
+	}
+	stats, exists := pm.badProxies[prx]
+	if !exists || stats.brk.state != halfOpen || stats.brk.trials == 0 {
+		return
+	}
+	stats.brk.trials--
+	pm.badProxies[prx] = stats
+	pm.cond.Broadcast()
+}
+
+// applies a result of a proxy from badProxies, reports false if prx isn't there
+func (pm *ProxyManager) handleTrial(prx *Proxy, res Result) bool {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+
+	prx = pm.resolve(prx)
+	stats, exists := pm.badProxies[prx]
+	if !exists {
+		return false
+	}
+	if (res.Err == nil && res.Dur == 0) || stats.brk.state != halfOpen {
+		// passive report or a result of what was given before the breaker tripped, not a trial
+		return true
+	}
+	now := time.Now()
+	if stats.brk.trials > 0 {
+		stats.brk.trials--
+	}
+
+	if res.Err != nil {
+		class := ClassOf(res.Err)
+		if pm.penalties[class] == 0 {
+			// not the proxy's fault, so it says nothing about the proxy
+			pm.badProxies[prx] = stats
+			return true
+		}
+		stats.lastErr = class.String() + ": " + res.Err.Error()
+		if pm.maxDead != 0 && now.Sub(stats.brk.openedAt) > pm.maxDead {
+			delete(pm.badProxies, prx)
+			delete(pm.byKey, prx.key())
+			pm.forgetMetrics(prx)
+			pm.dropped[prx.key()] = struct{}{}
+			pm.Logger().Warn("proxy is dropped for being dead too long", "proxy", prx.Address, "protocol", prx.Proto.String(),
+				"duration", now.Sub(stats.brk.openedAt).Round(time.Second), "last_error", stats.lastErr)
+			return true
+		}
+		stats.brk.trip(now, pm.brkCooldown)
+		pm.badProxies[prx] = stats
+		return true
+	}
+
+	stats.latency.add(res.Dur, pm.ewmaAlpha)
+	stats.brk.successes++
+	if stats.brk.successes < pm.promoteAfter {
+		pm.badProxies[prx] = stats
+		return true
+	}
+
+	badFor := now.Sub(stats.brk.openedAt).Round(time.Second)
+	stats.brk.reset()
+	delete(pm.badProxies, prx)
+	pm.proxies[prx] = stats
+	pm.sortedProxies = append(pm.sortedProxies, prx)
+	pm.sortProxies()
+	pm.cond.Broadcast()
+	pm.Logger().Info("proxy is back", "proxy", prx.Address, "protocol", prx.Proto.String(),
+		"trials", pm.promoteAfter, "duration", badFor)
+	return true
+}
+
+// returns a bad proxy which may get a trial and is the most likely to work, nil if there are none. must be called with lock held
+func (pm *ProxyManager) halfOpenProxy() *Proxy {
+	var best *Proxy
+	var bestStats proxyStats
+	now := time.Now()
+	for prx, stats := range pm.badProxies {
+		if !stats.brk.trialAllowed(now) {
+			continue
+		}
+		pm.badProxies[prx] = stats
+		if best == nil || stats.brk.successes > bestStats.brk.successes {
+			best, bestStats = prx, stats
+		}
+	}
+	if best != nil {
+		pm.takeTrial(best, now)
+	}
+	return best
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+)
+
+var (
+	errRefused  = NewError(ErrRefused, "s5 stage2r", "connection refused")
+	errCanceled = NewError(ErrCanceled, "dial", "client left")
+	errTarget   = NewError(ErrTargetUnreach, "s5 stage2r", "host unreachable")
+)
+
+func newBreakerManager(prx *Proxy) *ProxyManager {
+	pm := newTestManager()
+	pm.SetBreaker(4, 2, 0.5, time.Minute)
+	pm.SetProbing(2, 0)
+	pm.SetSource("s", []*Proxy{prx})
+	return pm
+}
+
+// returns the breaker of prx, or false if the manager doesn't have it
+func breakerOf(pm *ProxyManager, prx *Proxy) (breaker, bool) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	if stats, ok := pm.proxies[prx]; ok {
+		return stats.brk, true
+	}
+	stats, ok := pm.badProxies[prx]
+	return stats.brk, ok
+}
+
+// ends the cooldown of a bad proxy and takes a trial slot as Acquire would
+func endCooldown(t *testing.T, pm *ProxyManager, prx *Proxy) {
+	t.Helper()
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	stats := pm.badProxies[prx]
+	stats.brk.until = time.Now().Add(-time.Second)
+	pm.badProxies[prx] = stats
+	if !pm.takeTrial(prx, time.Now()) {
+		t.Fatal("no trial after the cooldown")
+	}
+}
+
+func TestBreakerTrip(t *testing.T) {
+	ok := Result{Dur: 10 * time.Millisecond}
+	tests := []struct {
+		name     string
+		outcomes []Result
+		open     bool
+	}{
+		{"one failure is too few samples", []Result{{Err: errRefused}}, false},
+		{"half of the window failed", []Result{ok, {Err: errRefused}}, true},
+		{"a third failed", []Result{ok, ok, {Err: errRefused}}, false},
+		{"a failure among successes", []Result{ok, ok, {Err: errRefused}, ok, ok, ok}, false},
+		{"failures which aren't the proxy's fault", []Result{{Err: errCanceled}, {Err: errTarget}, {Err: errCanceled}}, false},
+		{"the window fills with failures", []Result{ok, ok, ok, ok, {Err: errRefused}, {Err: errRefused}}, true},
+	}
+	for _, tt := range tests {
+		prx := &Proxy{Address: "203.0.113.1:1080", Proto: SOCKS5}
+		pm := newBreakerManager(prx)
+		for _, res := range tt.outcomes {
+			pm.handleResult(prx, res)
+		}
+		brk, _ := breakerOf(pm, prx)
+		if open := brk.state == open; open != tt.open {
+			t.Errorf("%s: breaker is %s", tt.name, brk.state)
+		}
+		if good, bad := pm.PoolSizes(); tt.open && (good != 0 || bad != 1) || !tt.open && (good != 1 || bad != 0) {
+			t.Errorf("%s: %d good and %d bad proxies", tt.name, good, bad)
+		}
+	}
+}
+
+// open, half-open after the cooldown, open again for twice as long after a failed
+// trial and closed after enough successful ones
+func TestBreakerRecovery(t *testing.T) {
+	prx := &Proxy{Address: "203.0.113.1:1080", Proto: SOCKS5}
+	pm := newBreakerManager(prx)
+	pm.handleResult(prx, Result{Err: errRefused})
+	pm.handleResult(prx, Result{Err: errRefused})
+	brk, _ := breakerOf(pm, prx)
+	if brk.state != open || brk.cooldown != time.Minute {
+		t.Fatalf("breaker is %s with cooldown %v after failures", brk.state, brk.cooldown)
+	}
+	pm.cond.L.Lock()
+	early := pm.takeTrial(prx, time.Now())
+	pm.cond.L.Unlock()
+	if early {
+		t.Fatal("a trial is given during the cooldown")
+	}
+
+	for _, cd := range []time.Duration{2 * time.Minute, 4 * time.Minute} {
+		endCooldown(t, pm, prx)
+		if brk, _ := breakerOf(pm, prx); brk.state != halfOpen || brk.trials != 1 {
+			t.Fatalf("breaker is %s with %d trials after the cooldown", brk.state, brk.trials)
+		}
+		pm.handleResult(prx, Result{Err: errRefused})
+		if brk, _ := breakerOf(pm, prx); brk.state != open || brk.cooldown != cd {
+			t.Fatalf("breaker is %s with cooldown %v after a failed trial, want open for %v", brk.state, brk.cooldown, cd)
+		}
+	}
+
+	endCooldown(t, pm, prx)
+	pm.handleResult(prx, Result{Dur: 10 * time.Millisecond})
+	if brk, _ := breakerOf(pm, prx); brk.state != halfOpen || brk.successes != 1 {
+		t.Fatalf("breaker is %s with %d successes after one successful trial", brk.state, brk.successes)
+	}
+	pm.cond.L.Lock()
+	pm.takeTrial(prx, time.Now())
+	pm.cond.L.Unlock()
+	pm.handleResult(prx, Result{Dur: 10 * time.Millisecond})
+	brk, _ = breakerOf(pm, prx)
+	if brk.state != closed || len(brk.window) != 0 {
+		t.Fatalf("breaker is %s with window %v after promotion", brk.state, brk.window)
+	}
+	if !slices.Equal(pm.sortedProxies, []*Proxy{prx}) {
+		t.Error("the promoted proxy isn't ranked")
+	}
+}
+
+func TestBreakerTrials(t *testing.T) {
+	prx := &Proxy{Address: "203.0.113.1:1080", Proto: SOCKS5}
+	pm := newBreakerManager(prx)
+	pm.handleResult(prx, Result{Err: errRefused})
+	pm.handleResult(prx, Result{Err: errRefused})
+	endCooldown(t, pm, prx)
+
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	now := time.Now()
+	for range constants.PRXBRKTRIALS - 1 {
+		if !pm.takeTrial(prx, now) {
+			t.Fatal("a trial slot is missing")
+		}
+	}
+	if pm.takeTrial(prx, now) {
+		t.Errorf("more than %d trials in flight", constants.PRXBRKTRIALS)
+	}
+	// unanswered trials are considered lost after a while
+	if !pm.takeTrial(prx, now.Add(constants.PRXBRKTRIALTO+time.Second)) {
+		t.Error("lost trials hold their slots")
+	}
+}
+
+func TestBreakerCooldownCap(t *testing.T) {
+	var b breaker
+	now := time.Now()
+	b.trip(now, time.Minute)
+	for range 10 {
+		b.trip(now, time.Minute)
+	}
+	if b.cooldown != constants.PRXBRKMAXCD || !b.until.Equal(now.Add(constants.PRXBRKMAXCD)) {
+		t.Errorf("cooldown %v until %v, want %v", b.cooldown, b.until, constants.PRXBRKMAXCD)
+	}
+	if !b.openedAt.Equal(now) {
+		t.Error("openedAt moves with failed trials")
+	}
+}
+
+// a proxy which has been bad for longer than maxDead is dropped at its next failed
+// trial and isn't taken back when it is listed again
+func TestBreakerMaxDead(t *testing.T) {
+	prx := &Proxy{Address: "203.0.113.1:1080", Proto: SOCKS5}
+	pm := newBreakerManager(prx)
+	pm.SetProbing(2, time.Hour)
+	pm.handleResult(prx, Result{Err: errRefused})
+	pm.handleResult(prx, Result{Err: errRefused})
+	endCooldown(t, pm, prx)
+	pm.handleResult(prx, Result{Err: errRefused})
+	if _, ok := breakerOf(pm, prx); !ok {
+		t.Fatal("the proxy is dropped before maxDead")
+	}
+
+	pm.cond.L.Lock()
+	stats := pm.badProxies[prx]
+	stats.brk.openedAt = time.Now().Add(-2 * time.Hour)
+	pm.badProxies[prx] = stats
+	pm.cond.L.Unlock()
+	endCooldown(t, pm, prx)
+	pm.handleResult(prx, Result{Err: errRefused})
+	if _, ok := breakerOf(pm, prx); ok {
+		t.Fatal("the proxy isn't dropped after maxDead")
+	}
+	pm.SetSource("s", []*Proxy{{Address: "203.0.113.1:1080", Proto: SOCKS5}})
+	if good, bad := pm.PoolSizes(); good+bad != 0 {
+		t.Errorf("the dropped proxy is back: %d good and %d bad", good, bad)
+	}
+}
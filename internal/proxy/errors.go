@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrClass tells what exactly went wrong while using a proxy, so that failures
+// of the proxy itself can be told apart from failures of the destination
+type ErrClass uint8
+
+const (
+	ErrDial          ErrClass = iota // couldn't connect to the proxy
+	ErrTimeout                       // proxy (or something behind it) didn't answer in time
+	ErrTLS                           // tls handshake with the proxy failed
+	ErrAuth                          // proxy didn't accept our authentication
+	ErrProto                         // proxy answered something we don't understand
+	ErrRefused                       // proxy refused to connect to the requested target
+	ErrTargetUnreach                 // proxy couldn't reach the requested target
+	ErrCheck                         // tunnel was established, but checking request through it failed
+	ErrIO                            // connection with the proxy broke
+	ErrCanceled                      // whoever wanted the connection gave up on it (client left, shutdown)
+	errClassCount
+)
+
+var errClassNames = [errClassCount]string{
+	ErrDial:          "dial",
+	ErrTimeout:       "timeout",
+	ErrTLS:           "tls",
+	ErrAuth:          "auth",
+	ErrProto:         "proto",
+	ErrRefused:       "refused",
+	ErrTargetUnreach: "target",
+	ErrCheck:         "check",
+	ErrIO:            "io",
+	ErrCanceled:      "canceled",
+}
+
+func (c ErrClass) String() string {
+	if c < errClassCount {
+		return errClassNames[c]
+	}
+	return "unknown"
+}
+
+// Error is an error of using a proxy, reported in a Result
+type Error struct {
+	Class ErrClass
+	Stage string // where it happened, e.g. "s5 stage2r"
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NewError makes an *Error with a formatted message
+func NewError(class ErrClass, stage string, format string, a ...any) *Error {
+	return &Error{Class: class, Stage: stage, Err: fmt.Errorf(format, a...)}
+}
+
+// ClassOf returns the class of err, errors not made by this package are ErrIO
+func ClassOf(err error) ErrClass {
+	var perr *Error
+	if errors.As(err, &perr) {
+		return perr.Class
+	}
+	return ErrIO
+}
+
+// Penalties tells how many errors are added to a proxy's counter for each
+// error class. 0 means the failure is not the proxy's fault
+type Penalties [errClassCount]uint8
+
+// DefaultPenalties punishes the proxy for everything except unreachable targets and cancellation
+func DefaultPenalties() Penalties {
+	var p Penalties
+	for i := range p {
+		p[i] = 1
+	}
+	p[ErrTargetUnreach] = 0
+	p[ErrCanceled] = 0
+	return p
+}
+
+// ParsePenalties applies overrides like "target=0,refused=2" on top of DefaultPenalties
+func ParsePenalties(s string) (Penalties, error) {
+	p := DefaultPenalties()
+	if s == "" {
+		return p, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		name, val, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return p, errors.New("expected class=penalty, got " + kv)
+		}
+		class := errClassCount
+		for i, n := range errClassNames {
+			if n == name {
+				class = ErrClass(i)
+			}
+		}
+		if class == errClassCount {
+			return p, errors.New("unknown error class " + name)
+		}
+		n, err := strconv.ParseUint(val, 10, 8)
+		if err != nil {
+			return p, err
+		}
+		p[class] = uint8(n)
+	}
+	return p, nil
+}
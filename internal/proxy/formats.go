@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"regexp"
+)
+
+// formats of proxy lists
+const (
+	FormatAuto    = "auto"    // guessed from the contents
+	FormatLines   = "lines"   // one proxy url or share link per line
+	FormatBase64  = "base64"  // subscription: base64 encoded block of lines
+	FormatClash   = "clash"   // clash config (yaml), its proxies list
+	FormatSingBox = "singbox" // sing-box config (json), its outbounds
+	FormatXray    = "xray"    // xray config (json), its outbounds
+	FormatPool    = "pool"    // pool file (yaml or json) with per-proxy options
+)
+
+var (
+	errUnknownProto = errors.New("unknown proto")
+	errInvalidAddr  = errors.New("invalid addr format")
+)
+
+// IsFormat tells if format is a known proxy list format
+func IsFormat(format string) bool {
+	switch format {
+	case FormatAuto, FormatLines, FormatBase64, FormatClash, FormatSingBox, FormatXray, FormatPool:
+		return true
+	}
+	return false
+}
+
+// ParseOptions tell how to read a proxy list
+type ParseOptions struct {
+	Format string // one of the formats, FormatAuto if empty
+	Name   string // where the list came from, used in diagnostics
+	Proto  string // protocol of entries without a scheme: http, https, socks4, socks5 or ProtoDetect. empty makes them bad entries
+	Strict bool   // any bad entry fails the whole list with a ListError
+
+	Logger *slog.Logger // where bad entries are warned about, nil is the default logger
+
+	// probes proxies whose protocol is to be detected and sets their Proto,
+	// errors are of the ones it couldn't detect. needed for ProtoDetect
+	Detect func([]*Proxy) []error
+}
+
+// Parse reads a proxy list. bad entries are skipped with a warning, unless opts is strict
+func Parse(data []byte, opts ParseOptions) ([]*Proxy, error) {
+	l, err := parse(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Strict && len(l.diags) != 0 {
+		return nil, ListError(l.diags)
+	}
+	for _, d := range l.diags {
+		l.log.Warn(d.Err.Error(), d.attrs()...)
+	}
+	return l.proxies, nil
+}
+
+func parse(data []byte, opts ParseOptions) (*list, error) {
+	if opts.Proto != "" && !IsProto(opts.Proto) {
+		return nil, errors.New("unknown protocol " + opts.Proto)
+	}
+	if opts.Proto == ProtoDetect && opts.Detect == nil {
+		return nil, errors.New("protocol detection is unavailable")
+	}
+	format := opts.Format
+	switch format {
+	case "", FormatAuto:
+		format = detectFormat(data)
+	}
+	l := newList(opts.Name, opts.Proto)
+	if opts.Logger != nil {
+		l.log = opts.Logger
+	}
+	var err error
+	switch format {
+	case FormatLines:
+		err = parseLines(bytes.NewReader(data), l)
+	case FormatBase64:
+		decoded, ok := decodeBase64(data)
+		if !ok {
+			return nil, errors.New("not a base64 subscription")
+		}
+		err = parseLines(bytes.NewReader(decoded), l)
+	case FormatClash:
+		err = parseClash(data, l)
+	case FormatSingBox:
+		err = parseSingBox(data, l)
+	case FormatXray:
+		err = parseXray(data, l)
+	case FormatPool:
+		err = parsePool(data, l)
+	default:
+		err = errors.New("unknown format " + format)
+	}
+	if err == nil && len(l.undetected) != 0 {
+		l.detect(opts.Detect)
+	}
+	return l, err
+}
+
+var (
+	clashProxies = regexp.MustCompile(`(?m)^proxies:`)
+	poolList     = regexp.MustCompile(`(?m)^pool:`)
+)
+
+// guesses the format of a proxy list
+func detectFormat(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		var conf struct {
+			Outbounds []struct {
+				Protocol string `json:"protocol"` // xray's, sing-box has type instead
+			} `json:"outbounds"`
+			Pool json.RawMessage `json:"pool"`
+		}
+		if json.Unmarshal(trimmed, &conf) == nil {
+			switch {
+			case conf.Pool != nil:
+				return FormatPool
+			case conf.Outbounds != nil:
+				for _, ob := range conf.Outbounds {
+					if ob.Protocol != "" {
+						return FormatXray
+					}
+				}
+				return FormatSingBox
+			}
+		}
+	}
+	if poolList.Match(data) {
+		return FormatPool
+	}
+	if clashProxies.Match(data) {
+		return FormatClash
+	}
+	if decoded, ok := decodeBase64(data); ok && bytes.Contains(decoded, []byte("://")) {
+		return FormatBase64
+	}
+	return FormatLines
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+)
+
+// ProxyInfo is a read-only view of a proxy and its statistics
+type ProxyInfo struct {
+	Address    string
+	Proto      Protocol
+	Tags       []string
+	Weight     float64
+	Bad        bool          // proxy is in badProxies
+	Latency    time.Duration // ewma of handshake time
+	P50        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+	Samples    uint64
+	Throughput float64 // bytes per second, 0 if never measured
+	State      string  // breaker state: closed, open or half-open
+	FailRate   float64 // failure rate in breaker's window
+	LastErr    string
+	ExitIP     string
+	LastCheck  time.Time
+	InFlight   int // relays running through the proxy
+}
+
+// Key identifies prx the way the manager does: by protocol, address and credentials
+// (passwords hashed), xray proxies by their outbounds
+func Key(prx *Proxy) string {
+	return prx.key()
+}
+
+func newProxyInfo(prx *Proxy, stats proxyStats, bad bool) ProxyInfo {
+	return ProxyInfo{
+		Address:    prx.Address,
+		Proto:      prx.Proto,
+		Tags:       prx.Tags,
+		Weight:     prx.Weight,
+		Bad:        bad,
+		Latency:    stats.latency.ewma,
+		P50:        stats.latency.percentile(0.50),
+		P95:        stats.latency.percentile(0.95),
+		P99:        stats.latency.percentile(0.99),
+		Samples:    stats.latency.samples,
+		Throughput: stats.throughput,
+		State:      stats.brk.state.String(),
+		FailRate:   stats.brk.failRate(),
+		LastErr:    stats.lastErr,
+		ExitIP:     stats.exitIP,
+		LastCheck:  stats.lastCheck,
+		InFlight:   stats.inFlight,
+	}
+}
+
+// List returns every proxy in the manager, ordered by key
+func (pm *ProxyManager) List() []*Proxy {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+
+	keys := slices.Sorted(maps.Keys(pm.byKey))
+	proxies := make([]*Proxy, len(keys))
+	for i, key := range keys {
+		proxies[i] = pm.byKey[key]
+	}
+	return proxies
+}
+
+// PoolSizes returns how many proxies are good and bad
+func (pm *ProxyManager) PoolSizes() (good int, bad int) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	return len(pm.proxies), len(pm.badProxies)
+}
+
+// Snapshot returns all proxies in ranking order followed by bad ones
+func (pm *ProxyManager) Snapshot() []ProxyInfo {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+
+	infos := make([]ProxyInfo, 0, len(pm.proxies)+len(pm.badProxies))
+	for _, prx := range pm.sortedProxies {
+		infos = append(infos, newProxyInfo(prx, pm.proxies[prx], false))
+	}
+	for prx, stats := range pm.badProxies {
+		infos = append(infos, newProxyInfo(prx, stats, true))
+	}
+	return infos
+}
+
+// periodically logs pool sizes and PRXLOGTOP best proxies with their statistics until ctx is done
+func (pm *ProxyManager) ServeStatsLog(ctx context.Context, every time.Duration) {
+	for sleepCtx(ctx, every) {
+		infos := pm.Snapshot()
+		good := 0
+		for _, info := range infos {
+			if !info.Bad {
+				good++
+			}
+		}
+		pm.Logger().Info("pool", "good", good, "bad", len(infos)-good)
+		for i := 0; i < good && i < constants.PRXLOGTOP; i++ {
+			info := infos[i]
+			pm.Logger().Info("pool top", "rank", i+1, "proxy", info.Address, "protocol", info.Proto.String(),
+				"latency", info.Latency, "p50", info.P50, "p95", info.P95, "p99", info.P99, "samples", info.Samples,
+				"throughput", info.Throughput, "fail_rate", info.FailRate, "exit_ip", info.ExitIP)
+		}
+	}
+}
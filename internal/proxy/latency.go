@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"slices"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+)
+
+// latency estimates proxy's handshake time: ewma is used for ranking, the
+// ring of last PRXLATWINDOW samples is used for percentiles
+type latency struct {
+	ewma    time.Duration
+	samples uint64
+	window  []time.Duration
+	next    int
+}
+
+// returns an estimator with ewma set to initial until the first sample arrives
+func newLatency(initial time.Duration) latency {
+	return latency{ewma: initial}
+}
+
+func (l *latency) add(d time.Duration, alpha float64) {
+	if l.samples == 0 {
+		l.ewma = d
+	} else {
+		l.ewma = time.Duration(alpha*float64(d) + (1-alpha)*float64(l.ewma))
+	}
+	l.samples++
+
+	if len(l.window) < constants.PRXLATWINDOW {
+		l.window = append(l.window, d)
+	} else {
+		l.window[l.next] = d
+		l.next = (l.next + 1) % constants.PRXLATWINDOW
+	}
+}
+
+// returns p-th (0..1) percentile of the samples in the window, 0 if there are none
+func (l latency) percentile(p float64) time.Duration {
+	if len(l.window) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(l.window)
+	slices.Sort(sorted)
+	idx := int(p*float64(len(sorted)) + 0.5)
+	if idx > 0 {
+		idx--
+	}
+	return sorted[min(idx, len(sorted)-1)]
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+)
+
+func TestLatencyPercentile(t *testing.T) {
+	ms := time.Millisecond
+	fifty := make([]time.Duration, 50)
+	for i := range fifty {
+		fifty[i] = time.Duration(50-i) * ms
+	}
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		p       float64
+		want    time.Duration
+	}{
+		{"no samples", nil, 0.5, 0},
+		{"one sample", []time.Duration{7 * ms}, 0.99, 7 * ms},
+		{"median of odd", []time.Duration{30 * ms, 10 * ms, 20 * ms}, 0.5, 20 * ms},
+		{"p0 is the minimum", []time.Duration{30 * ms, 10 * ms, 20 * ms}, 0, 10 * ms},
+		{"p100 is the maximum", []time.Duration{30 * ms, 10 * ms, 20 * ms}, 1, 30 * ms},
+		{"p50 of 4", []time.Duration{40 * ms, 10 * ms, 30 * ms, 20 * ms}, 0.5, 20 * ms},
+		{"p95 of 4", []time.Duration{40 * ms, 10 * ms, 30 * ms, 20 * ms}, 0.95, 40 * ms},
+		{"p50 of 50", fifty, 0.50, 25 * ms},
+		{"p95 of 50", fifty, 0.95, 48 * ms},
+		{"p99 of 50", fifty, 0.99, 50 * ms},
+	}
+	for _, tt := range tests {
+		var l latency
+		for _, d := range tt.samples {
+			l.add(d, 0.5)
+		}
+		if got := l.percentile(tt.p); got != tt.want {
+			t.Errorf("%s: percentile(%v) = %v, want %v", tt.name, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestLatencyEWMA(t *testing.T) {
+	l := newLatency(time.Second)
+	if l.ewma != time.Second || l.samples != 0 {
+		t.Fatalf("initial estimate %v with %d samples", l.ewma, l.samples)
+	}
+	// the first sample replaces the initial estimate
+	l.add(100*time.Millisecond, 0.25)
+	if l.ewma != 100*time.Millisecond {
+		t.Errorf("ewma %v after the first sample", l.ewma)
+	}
+	l.add(500*time.Millisecond, 0.25)
+	if l.ewma != 200*time.Millisecond || l.samples != 2 {
+		t.Errorf("ewma %v with %d samples, want 200ms with 2", l.ewma, l.samples)
+	}
+}
+
+// only the last PRXLATWINDOW samples count for percentiles
+func TestLatencyWindow(t *testing.T) {
+	var l latency
+	for range constants.PRXLATWINDOW {
+		l.add(time.Second, 0.5)
+	}
+	for range constants.PRXLATWINDOW {
+		l.add(time.Millisecond, 0.5)
+	}
+	if len(l.window) != constants.PRXLATWINDOW || l.samples != 2*constants.PRXLATWINDOW {
+		t.Fatalf("window of %d with %d samples", len(l.window), l.samples)
+	}
+	if p := l.percentile(1); p != time.Millisecond {
+		t.Errorf("max %v, old samples are still in the window", p)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+	"github.com/etidart/proxyflow/internal/metrics"
+)
+
+// Purpose tells what a leased proxy is for
+type Purpose uint8
+
+const (
+	Relay Purpose = iota // carrying traffic: the best proxy which isn't saturated
+	Check                // checking: a random proxy due for a check
+)
+
+// Criteria tell Acquire which proxy to lease
+type Criteria struct {
+	Purpose Purpose
+}
+
+// Result is what was learned while using a leased proxy
+type Result struct {
+	Err    error
+	Dur    time.Duration // handshake time, 0 for passive reports
+	Tput   float64       // measured throughput in bytes per second, 0 if not measured
+	ExitIP string        // ip the proxy connects to targets from, empty if not measured
+}
+
+// ErrNoProxies is returned by Acquire when there is no proxy to lease for a relay
+var ErrNoProxies = errors.New("there are no proxies")
+
+// Lease is a proxy given by Acquire. it must be released once the proxy isn't
+// used anymore, results are reported before that
+type Lease struct {
+	Prx     *Proxy
+	ProbeBW bool // check leases: the checker should also measure throughput
+	ProbeIP bool // check leases: the checker should also learn the exit ip
+
+	pm       *ProxyManager
+	purpose  Purpose
+	trial    bool        // the lease holds a trial slot of a half-open proxy
+	answered atomic.Bool // a handshake result was reported
+	once     sync.Once
+}
+
+// Acquire leases a proxy for c's purpose, it is safe for concurrent use. relay leases
+// are given at once (ErrNoProxies if there is nothing to give) and count towards the
+// proxy's cap until released. check leases wait until a proxy is due for a check
+// (bad proxies when their breakers allow a trial) or ctx is done
+func (pm *ProxyManager) Acquire(ctx context.Context, c Criteria) (*Lease, error) {
+	if c.Purpose == Check {
+		return pm.acquireCheck(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	prx, trial := pm.getBestProxy()
+	if prx == nil {
+		return nil, ErrNoProxies
+	}
+	return &Lease{Prx: prx, pm: pm, purpose: Relay, trial: trial}, nil
+}
+
+func (pm *ProxyManager) acquireCheck(ctx context.Context) (*Lease, error) {
+	stop := context.AfterFunc(ctx, pm.wake)
+	defer stop()
+
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		prx, wait := pm.nextCheck(time.Now())
+		if prx != nil {
+			_, bad := pm.badProxies[prx]
+			l := &Lease{Prx: prx, pm: pm, purpose: Check, trial: bad}
+			l.ProbeBW, l.ProbeIP = pm.probesDue(prx)
+			return l, nil
+		}
+		// proxies being added wake us up too
+		if wait == 0 {
+			pm.cond.Wait()
+			continue
+		}
+		t := time.AfterFunc(wait, pm.wake)
+		pm.cond.Wait()
+		t.Stop()
+	}
+}
+
+func (pm *ProxyManager) wake() {
+	pm.cond.L.Lock()
+	pm.cond.Broadcast()
+	pm.cond.L.Unlock()
+}
+
+// picks a random proxy due for a check, taking a trial slot if it is bad. if there
+// is none, tells how long until one may be due, 0 if there are no proxies at all.
+// pm.cond.L must be held
+func (pm *ProxyManager) nextCheck(now time.Time) (*Proxy, time.Duration) {
+	var due []*Proxy
+	var wait time.Duration
+	later := func(d time.Duration) {
+		if wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	for _, prx := range pm.sortedProxies {
+		next := pm.proxies[prx].checkGiven.Add(checkInterval(prx))
+		if next.After(now) {
+			later(next.Sub(now))
+			continue
+		}
+		due = append(due, prx)
+	}
+	for prx, stats := range pm.badProxies {
+		next := stats.checkGiven.Add(checkInterval(prx))
+		switch {
+		case next.After(now):
+			later(next.Sub(now))
+		case stats.brk.trialAllowed(now):
+			pm.badProxies[prx] = stats
+			due = append(due, prx)
+		default:
+			// cooling down
+			later(constants.PRXCHKCD)
+		}
+	}
+
+	for len(due) != 0 {
+		i := rand.Intn(len(due))
+		prx := due[i]
+		if stats, good := pm.proxies[prx]; good {
+			stats.checkGiven = now
+			pm.proxies[prx] = stats
+			return prx, 0
+		}
+		if pm.takeTrial(prx, now) {
+			stats := pm.badProxies[prx]
+			stats.checkGiven = now
+			pm.badProxies[prx] = stats
+			return prx, 0
+		}
+		due[i] = due[len(due)-1]
+		due = due[:len(due)-1]
+	}
+	return nil, wait
+}
+
+// Report applies res to the proxy's statistics. it can be called more than once,
+// e.g. after the handshake and with the throughput once the relay is over
+func (l *Lease) Report(res Result) {
+	if l.purpose == Check {
+		if res.Err != nil {
+			metrics.Checks.Inc(ClassOf(res.Err).String())
+		} else {
+			metrics.Checks.Inc("ok")
+		}
+	}
+	if res.Err != nil || res.Dur != 0 {
+		l.answered.Store(true)
+	}
+	l.pm.handleResult(l.Prx, res)
+	if l.purpose == Check {
+		l.pm.markChecked(l.Prx, res)
+	}
+}
+
+// Release gives the proxy back, calling it again does nothing. a trial which
+// got no result frees its slot
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		if l.purpose == Relay {
+			l.pm.release(l.Prx)
+		}
+		if l.trial && !l.answered.Load() {
+			l.pm.freeTrial(l.Prx)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func newTestManager() *ProxyManager {
+	pm := NewProxyManager()
+	pm.SetLogger(slog.New(slog.DiscardHandler))
+	return pm
+}
+
+// a lease taken before its proxy is removed and listed again reports to the proxy
+// the manager has now
+func TestLeaseAfterReAdd(t *testing.T) {
+	for _, purpose := range []Purpose{Relay, Check} {
+		pm := newTestManager()
+		if _, _, err := pm.SetSource("s", []*Proxy{{Address: "203.0.113.1:1080", Proto: SOCKS5}}); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		lease, err := pm.Acquire(ctx, Criteria{Purpose: purpose})
+		cancel()
+		if err != nil {
+			t.Fatalf("purpose %d: Acquire: %v", purpose, err)
+		}
+
+		pm.SetSource("s", nil)
+		again := &Proxy{Address: "203.0.113.1:1080", Proto: SOCKS5}
+		pm.SetSource("s", []*Proxy{again})
+		if again == lease.Prx {
+			t.Fatal("the proxy wasn't added again")
+		}
+
+		lease.Report(Result{Dur: 50 * time.Millisecond, ExitIP: "198.51.100.1"})
+		lease.Release()
+		stats := pm.proxies[again]
+		if stats.latency.samples != 1 || stats.latency.ewma != 50*time.Millisecond {
+			t.Errorf("purpose %d: the result is lost, latency %+v", purpose, stats.latency)
+		}
+		if purpose == Check && stats.exitIP != "198.51.100.1" {
+			t.Errorf("the check is lost, exit ip %q", stats.exitIP)
+		}
+		if stats.inFlight != 0 {
+			t.Errorf("purpose %d: %d relays in flight after release", purpose, stats.inFlight)
+		}
+	}
+}
+
+// a trial lease released without a result gives its slot back at once
+func TestReleaseFreesTrial(t *testing.T) {
+	for _, purpose := range []Purpose{Relay, Check} {
+		for _, report := range []bool{false, true} {
+			prx := &Proxy{Address: "203.0.113.1:1080", Proto: SOCKS5}
+			pm := newBreakerManager(prx)
+			pm.handleResult(prx, Result{Err: errRefused})
+			pm.handleResult(prx, Result{Err: errRefused})
+			pm.cond.L.Lock()
+			stats := pm.badProxies[prx]
+			stats.brk.until = time.Now().Add(-time.Second)
+			pm.badProxies[prx] = stats
+			pm.cond.L.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			lease, err := pm.Acquire(ctx, Criteria{Purpose: purpose})
+			cancel()
+			if err != nil {
+				t.Fatalf("purpose %d: Acquire: %v", purpose, err)
+			}
+			if !lease.trial {
+				t.Fatalf("purpose %d: the lease isn't a trial", purpose)
+			}
+			if report {
+				// a passive report says nothing about the trial
+				lease.Report(Result{Tput: 1 << 20})
+			}
+			lease.Release()
+			lease.Release()
+			brk, _ := breakerOf(pm, prx)
+			if brk.state != halfOpen || brk.trials != 0 {
+				t.Errorf("purpose %d, passive report %v: breaker is %s with %d trials after release",
+					purpose, report, brk.state, brk.trials)
+			}
+		}
+	}
+}
+
+// a trial which got its result doesn't give back another one's slot
+func TestReleaseAfterTrialResult(t *testing.T) {
+	prx := &Proxy{Address: "203.0.113.1:1080", Proto: SOCKS5}
+	pm := newBreakerManager(prx)
+	pm.handleResult(prx, Result{Err: errRefused})
+	pm.handleResult(prx, Result{Err: errRefused})
+	endCooldown(t, pm, prx)
+
+	lease, err := pm.Acquire(context.Background(), Criteria{Purpose: Relay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease.Report(Result{Dur: 10 * time.Millisecond})
+	lease.Release()
+	if brk, _ := breakerOf(pm, prx); brk.trials != 1 || brk.successes != 1 {
+		t.Errorf("%d trials and %d successes, want the first trial still in flight", brk.trials, brk.successes)
+	}
+}
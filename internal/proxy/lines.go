@@ -0,0 +1,373 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/logging"
+)
+
+// Diagnostic is a problem with an entry of a proxy list
+type Diagnostic struct {
+	File  string // where the list came from
+	Line  int    // line of the entry, 0 for formats without lines
+	Entry string // entry of structured formats, empty for line formats
+	Err   error
+}
+
+func (d Diagnostic) Error() string {
+	switch {
+	case d.Line != 0:
+		return fmt.Sprintf("%s:%d: %v", d.File, d.Line, d.Err)
+	case d.Entry != "":
+		return fmt.Sprintf("%s: %s: %v", d.File, d.Entry, d.Err)
+	}
+	return fmt.Sprintf("%s: %v", d.File, d.Err)
+}
+
+func (d Diagnostic) attrs() []any {
+	attrs := []any{"file", d.File}
+	if d.Line != 0 {
+		attrs = append(attrs, "line", d.Line)
+	}
+	if d.Entry != "" {
+		attrs = append(attrs, "entry", d.Entry)
+	}
+	return attrs
+}
+
+// ListError is every problem a strict Parse found in a list
+type ListError []Diagnostic
+
+func (e ListError) Error() string {
+	lines := make([]string, len(e))
+	for i, d := range e {
+		lines[i] = d.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+var errDuplicate = errors.New("duplicate proxy")
+
+// collects proxies of a list and problems with its entries
+type list struct {
+	name       string
+	proto      string // protocol of entries without a scheme
+	proxies    []*Proxy
+	seen       map[string]struct{}
+	diags      []Diagnostic
+	undetected []located // proxies whose protocol is to be detected
+	log        *slog.Logger
+}
+
+// a proxy and where in the list it is
+type located struct {
+	prx   *Proxy
+	line  int
+	entry string
+}
+
+func newList(name string, proto string) *list {
+	return &list{name: name, proto: proto, seen: make(map[string]struct{}), log: logging.Logger()}
+}
+
+// adds prx from line (or entry) unless the list already has it
+func (l *list) add(prx *Proxy, line int, entry string) {
+	key := prx.key()
+	if _, dup := l.seen[key]; dup {
+		l.bad(line, entry, errDuplicate)
+		return
+	}
+	l.seen[key] = struct{}{}
+	l.proxies = append(l.proxies, prx)
+	if prx.Proto == undetected {
+		l.undetected = append(l.undetected, located{prx, line, entry})
+	}
+}
+
+// records a problem with line (or entry)
+func (l *list) bad(line int, entry string, err error) {
+	l.diags = append(l.diags, Diagnostic{File: l.name, Line: line, Entry: entry, Err: err})
+}
+
+// detects protocols of the undetected proxies. the ones which couldn't be detected
+// are dropped with a warning: they are unreachable rather than bad entries
+func (l *list) detect(detect func([]*Proxy) []error) {
+	proxies := make([]*Proxy, len(l.undetected))
+	for i, u := range l.undetected {
+		proxies[i] = u.prx
+		delete(l.seen, u.prx.key())
+	}
+	var errs []error
+	if detect != nil {
+		errs = detect(proxies)
+	}
+
+	drop := make(map[*Proxy]struct{})
+	for i, u := range l.undetected {
+		var err error
+		switch {
+		case detect == nil:
+			err = errors.New("protocol detection is unavailable")
+		case errs[i] != nil:
+			err = fmt.Errorf("protocol not detected: %w", errs[i])
+		}
+		if err != nil {
+			d := Diagnostic{File: l.name, Line: u.line, Entry: u.entry, Err: err}
+			l.log.Warn(err.Error(), append(d.attrs(), "addr", u.prx.Address)...)
+			drop[u.prx] = struct{}{}
+			continue
+		}
+		// the same proxy may be in the list with a scheme
+		key := u.prx.key()
+		if _, dup := l.seen[key]; dup {
+			l.bad(u.line, u.entry, errDuplicate)
+			drop[u.prx] = struct{}{}
+			continue
+		}
+		l.seen[key] = struct{}{}
+	}
+	l.proxies = slices.DeleteFunc(l.proxies, func(prx *Proxy) bool {
+		_, dropped := drop[prx]
+		return dropped
+	})
+	l.undetected = nil
+}
+
+// reads proxies from r, one per line:
+//
+//	url [option=value ...] [# comment]
+//
+// url may lack a scheme, then it speaks the list's protocol or its proto option.
+// options are the ones of pool files (check ones as check.url and check.interval,
+// tags separated by commas), "#" starts a comment at the beginning of the line or
+// after whitespace, so share links keep their remarks
+func parseLines(r io.Reader, l *list) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		fields := strings.Fields(scanner.Text())
+		for i, f := range fields {
+			if strings.HasPrefix(f, "#") {
+				fields = fields[:i]
+				break
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		e := poolEntry{URL: fields[0]}
+		var err error
+		for _, opt := range fields[1:] {
+			if err = e.set(opt); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			l.bad(lineNumber, "", err)
+			continue
+		}
+		if e.Disabled {
+			continue
+		}
+		prx, err := e.proxy(l.proto)
+		if err != nil {
+			l.bad(lineNumber, "", err)
+			continue
+		}
+		l.add(prx, lineNumber, "")
+	}
+	return scanner.Err()
+}
+
+// URL gives prx's url with credentials, or the share link it was made of
+func URL(prx *Proxy) string {
+	if link := shareLink(prx); link != "" {
+		return link
+	}
+	u := url.URL{Scheme: prx.Proto.String(), Host: prx.Address}
+	if prx.User != "" {
+		u.User = url.UserPassword(prx.User, prx.Pass)
+	}
+	return u.String()
+}
+
+// Line formats prx as a line of a pfile, the way parseLines reads it
+func Line(prx *Proxy) string {
+	opts := []string{URL(prx)}
+	if prx.Weight != 0 {
+		opts = append(opts, "weight="+strconv.FormatFloat(prx.Weight, 'g', -1, 64))
+	}
+	if prx.MaxConns != 0 {
+		opts = append(opts, "maxconns="+strconv.Itoa(prx.MaxConns))
+	}
+	if len(prx.Tags) != 0 {
+		opts = append(opts, "tags="+strings.Join(prx.Tags, ","))
+	}
+	if prx.Check != nil && prx.Check.URL != "" {
+		opts = append(opts, "check.url="+prx.Check.URL)
+	}
+	if prx.Check != nil && prx.Check.Interval != 0 {
+		opts = append(opts, "check.interval="+prx.Check.Interval.String())
+	}
+	return strings.Join(opts, " ")
+}
+
+// sets an inline option (key=value, or a bare key for booleans) of a line
+func (e *poolEntry) set(opt string) error {
+	key, value, hasValue := strings.Cut(opt, "=")
+	var err error
+	switch key {
+	case "user":
+		e.User, err = url.PathUnescape(value)
+	case "pass":
+		e.Pass, err = url.PathUnescape(value)
+	case "proto":
+		e.Proto = value
+	case "weight":
+		e.Weight, err = strconv.ParseFloat(value, 64)
+	case "maxconns":
+		e.MaxConns, err = strconv.Atoi(value)
+	case "tags":
+		e.Tags = strings.Split(value, ",")
+	case "check.url":
+		e.Check.URL = value
+	case "check.interval":
+		e.Check.Interval, err = time.ParseDuration(value)
+	case "disabled":
+		e.Disabled = true
+		if hasValue {
+			e.Disabled, err = strconv.ParseBool(value)
+		}
+		hasValue = true
+	default:
+		return errors.New("unknown option " + key)
+	}
+	if !hasValue {
+		return errors.New("option " + key + " needs a value")
+	}
+	if err != nil {
+		return fmt.Errorf("bad option %s: %w", key, err)
+	}
+	return nil
+}
+
+// protocols of plain proxy urls by scheme
+var schemes = map[string]Protocol{
+	"http":   HTTP,
+	"https":  HTTPS,
+	"socks4": SOCKS4,
+	"socks5": SOCKS5,
+	"socks":  SOCKS5,
+}
+
+// ProtoDetect is a default protocol which makes entries without a scheme probed for
+// the protocol they speak
+const ProtoDetect = "detect"
+
+// marks proxies whose protocol is to be detected
+const undetected Protocol = 255
+
+// IsProto tells if proto can be the protocol of entries without a scheme
+func IsProto(proto string) bool {
+	_, ok := schemes[proto]
+	return ok || proto == ProtoDetect
+}
+
+// makes a proxy out of a url (which may have credentials) or share link. links without
+// a scheme ("host:port", "host:port:user:pass" or "user:pass@host:port") speak proto
+func parseLink(link string, proto string) (*Proxy, error) {
+	scheme, addr, found := strings.Cut(link, "://")
+	if !found && proto != "" {
+		return schemelessProxy(link, proto)
+	}
+	prot, plain := schemes[scheme]
+	if !found || !plain {
+		return shareLinkProxy(link)
+	}
+	addr, _, _ = strings.Cut(addr, "#") // remarks
+	addr, user, pass, ok := cutUserinfo(addr)
+	if !ok || !isValidAddress(addr) {
+		return nil, errInvalidAddr
+	}
+	return &Proxy{Address: addr, Proto: prot, User: user, Pass: pass}, nil
+}
+
+func schemelessProxy(link string, proto string) (*Proxy, error) {
+	prot, ok := schemes[proto]
+	if proto == ProtoDetect {
+		prot, ok = undetected, true
+	}
+	if !ok {
+		return nil, errors.New("unknown protocol " + proto)
+	}
+	addr, user, pass := link, "", ""
+	if strings.Contains(link, "@") {
+		addr, user, pass, ok = cutUserinfo(link)
+	} else if parts := strings.SplitN(link, ":", 4); len(parts) == 4 {
+		// vendor lists, the password may have colons
+		addr, user, pass = parts[0]+":"+parts[1], parts[2], parts[3]
+		ok = user != ""
+	}
+	if !ok || !isValidAddress(addr) {
+		return nil, errInvalidAddr
+	}
+	return &Proxy{Address: addr, Proto: prot, User: user, Pass: pass}, nil
+}
+
+// splits "user:pass@host:port" (user and pass may be url escaped) into its parts
+func cutUserinfo(addr string) (host string, user string, pass string, ok bool) {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return addr, "", "", true
+	}
+	user, pass, _ = strings.Cut(addr[:i], ":")
+	user, uerr := url.PathUnescape(user)
+	pass, perr := url.PathUnescape(pass)
+	return addr[i+1:], user, pass, uerr == nil && perr == nil && user != ""
+}
+
+func isValidAddress(addr string) bool {
+	// split the address into host and port
+	hostPort := strings.Split(addr, ":")
+	if len(hostPort) != 2 {
+		return false
+	}
+
+	host := hostPort[0]
+	portStr := hostPort[1]
+
+	// validate the host, an ipv4 address or a hostname as in subscriptions
+	if !isValidHost(host) {
+		return false
+	}
+
+	// validate the port number
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/metrics"
+)
+
+// tells if the metrics have handshake series of addr
+func hasHandshakes(addr string) bool {
+	var buf bytes.Buffer
+	metrics.WriteAll(&buf)
+	return strings.Contains(buf.String(), `proxyflow_handshake_seconds_count{proxy="`+addr+`"`)
+}
+
+// per-proxy series are deleted with the last proxy they belong to
+func TestMetricsOfRemovedProxies(t *testing.T) {
+	a := &Proxy{Address: "192.0.2.10:1080", Proto: SOCKS5, User: "u", Pass: "a"}
+	b := &Proxy{Address: "192.0.2.10:1080", Proto: SOCKS5, User: "u", Pass: "b"}
+	pm := newTestManager()
+	pm.SetSource("s", []*Proxy{a, b})
+	pm.handleResult(a, Result{Dur: 10 * time.Millisecond})
+	if !hasHandshakes(a.Address) {
+		t.Fatal("no series after a handshake")
+	}
+
+	pm.SetSource("s", []*Proxy{b})
+	if !hasHandshakes(a.Address) {
+		t.Error("the series is deleted while another proxy has it")
+	}
+	pm.SetSource("s", nil)
+	if hasHandshakes(a.Address) {
+		t.Error("the series outlives its proxies")
+	}
+	// a relay which is still running reports after its proxy is gone
+	pm.handleResult(b, Result{Dur: 10 * time.Millisecond})
+	if hasHandshakes(a.Address) {
+		t.Error("a late report brings the series back")
+	}
+}
+
+func TestMetricsOfDroppedProxies(t *testing.T) {
+	prx := &Proxy{Address: "192.0.2.11:1080", Proto: SOCKS5}
+	pm := newBreakerManager(prx)
+	pm.SetProbing(2, time.Nanosecond)
+	pm.handleResult(prx, Result{Dur: 10 * time.Millisecond})
+	pm.handleResult(prx, Result{Err: errRefused})
+	pm.handleResult(prx, Result{Err: errRefused})
+	endCooldown(t, pm, prx)
+	pm.handleResult(prx, Result{Err: errRefused})
+	if _, ok := breakerOf(pm, prx); ok {
+		t.Fatal("the proxy isn't dropped")
+	}
+	if hasHandshakes(prx.Address) {
+		t.Error("the series outlives the dropped proxy")
+	}
+}
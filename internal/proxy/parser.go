@@ -13,82 +13,25 @@
  */
 package proxy
 
-import (
-	"bufio"
-	"fmt"
-	"net"
-	"os"
-	"strconv"
-	"strings"
-
-	"github.com/etidart/proxyflow/internal/logging"
-)
-
-func parseLine(line string) (string, Protocol, bool) {
-	if strings.HasPrefix(line, "http://") {
-		return strings.TrimPrefix(line, "http://"), HTTP, false
-	} else if strings.HasPrefix(line, "https://") {
-		return strings.TrimPrefix(line, "https://"), HTTPS, false
-	} else if strings.HasPrefix(line, "socks4://") {
-		return strings.TrimPrefix(line, "socks4://"), SOCKS4, false
-	} else if strings.HasPrefix(line, "socks5://") {
-		return strings.TrimPrefix(line, "socks5://"), SOCKS5, false
-	}
-	return "", 0, true
+// makes a proxy out of a share link, they need xray which isn't embedded in this build
+func shareLinkProxy(link string) (*Proxy, error) {
+	return nil, errUnknownProto
 }
 
-func isValidAddress(addr string) bool {
-	// split the address into host and port
-	hostPort := strings.Split(addr, ":")
-	if len(hostPort) != 2 {
-		return false
-	}
-
-	host := hostPort[0]
-	portStr := hostPort[1]
-
-	// validate the IP address
-	if net.ParseIP(host) == nil {
-		return false
-	}
-
-	// validate the port number
-	port, err := strconv.Atoi(portStr)
-	if err != nil || port < 1 || port > 65535 {
-		return false
-	}
-
-	return true
+// share link of a proxy, there are none in this build
+func shareLink(prx *Proxy) string {
+	return ""
 }
 
-func (pm *ProxyManager) ParseFile(filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	lineNumber := 0
-	for scanner.Scan() {
-		lineNumber++
-		line := scanner.Text()
-		addr, prot, err := parseLine(line)
-		if err {
-			logging.Warn(fmt.Sprintf("unknown proto in %s, line %d", filename, lineNumber))
-			continue
-		}
-
-		if !isValidAddress(addr) {
-			logging.Warn(fmt.Sprintf("invalid addr format in %s, line %d", filename, lineNumber))
-			continue
-		}
-
-		pm.AddProxy(addr, prot)
-	}
+// xray outbound config of a proxy, there are none in this build
+func outbound(prx *Proxy) string {
+	return ""
+}
 
-	if err := scanner.Err(); err != nil {
-		return err
-	}
+// does nothing, xray is not embedded in this build
+func (pm *ProxyManager) syncXray(name string, proxies []*Proxy) error {
 	return nil
 }
+
+// StopXray does nothing, xray is not embedded in this build
+func (pm *ProxyManager) StopXray() {}
@@ -14,63 +14,61 @@
 package proxy
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"net"
-	"os"
 	"regexp"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 
-	"github.com/etidart/proxyflow/internal/logging"
+	"github.com/etidart/proxyflow/internal/metrics"
 	"github.com/xtls/libxray/share"
 	"github.com/xtls/libxray/xray"
 )
 
-func parseLine(line string) (string, Protocol, bool) {
-	if after, ok := strings.CutPrefix(line, "http://"); ok {
-		return after, HTTP, false
-	} else if after, ok := strings.CutPrefix(line, "https://"); ok {
-		return after, HTTPS, false
-	} else if after, ok := strings.CutPrefix(line, "socks4://"); ok {
-		return after, SOCKS4, false
-	} else if after, ok := strings.CutPrefix(line, "socks5://"); ok {
-		return after, SOCKS5, false
-	} else if after, ok := strings.CutPrefix(line, "socks://"); ok {
-		return after, SOCKS5, false
-	} else {
-		conf, err := share.ConvertShareLinksToXrayJson(line)
-		if err != nil {
-			return "", 0, true
-		}
-		str_conf, _ := json.Marshal(conf.OutboundConfigs[0])
-		return string(str_conf), XRAY, false
+// makes a proxy out of a share link. XRAY proxies get their addresses from syncXray
+// when they are added to a manager
+func shareLinkProxy(link string) (*Proxy, error) {
+	link, _, _ = strings.Cut(link, "#") // remarks don't make outbounds different
+	conf, err := share.ConvertShareLinksToXrayJson(link)
+	if err != nil || len(conf.OutboundConfigs) == 0 {
+		return nil, errUnknownProto
 	}
-}
-
-func isValidAddress(addr string) bool {
-	// split the address into host and port
-	hostPort := strings.Split(addr, ":")
-	if len(hostPort) != 2 {
-		return false
+	outbound, err := json.Marshal(conf.OutboundConfigs[0])
+	if err != nil {
+		return nil, err
 	}
+	return &Proxy{Proto: XRAY, Outbound: string(outbound), Link: link}, nil
+}
 
-	host := hostPort[0]
-	portStr := hostPort[1]
+// share link of an XRAY proxy, empty for others
+func shareLink(prx *Proxy) string {
+	return prx.Link
+}
 
-	// validate the IP address
-	if net.ParseIP(host) == nil {
-		return false
-	}
+// xray outbound config of an XRAY proxy, empty for others
+func outbound(prx *Proxy) string {
+	return prx.Outbound
+}
 
-	// validate the port number
-	port, err := strconv.Atoi(portStr)
-	if err != nil || port < 1 || port > 65535 {
-		return false
-	}
+var xrayLaunched atomic.Bool
 
-	return true
+func init() {
+	metrics.NewGaugeFunc("proxyflow_xray_running", "Whether the embedded xray instance is running (1) or not (0), absent until it is launched.", "",
+		func() map[string]float64 {
+			if !xrayLaunched.Load() {
+				return nil
+			}
+			if xray.GetXrayState() {
+				return map[string]float64{"": 1}
+			}
+			return map[string]float64{"": 0}
+		})
 }
 
 func getFreePort() (int, error) {
@@ -84,32 +82,36 @@ func getFreePort() (int, error) {
 	return addr.Port, nil
 }
 
-func launchXray(outbound_cfgs []string) int {
-	cfg := "{\"inbounds\":[{\"tag\":\"socks-inbound\",\"port\":"
-	free_port, err := getFreePort()
-	if err != nil {
-		panic(err)
+// launches xray with an outbound for each tag, reached through a socks inbound on
+// port (a free one if 0) with the tag as the username. returns the port
+func launchXray(port int, outbounds map[string]string) (int, error) {
+	if port == 0 {
+		var err error
+		if port, err = getFreePort(); err != nil {
+			return 0, err
+		}
 	}
-	cfg += fmt.Sprint(free_port)
+	tags := slices.Sorted(maps.Keys(outbounds))
+	cfg := "{\"inbounds\":[{\"tag\":\"socks-inbound\",\"port\":"
+	cfg += fmt.Sprint(port)
 	cfg += ",\"listen\":\"127.0.0.1\",\"protocol\":\"socks\",\"settings\":{\"auth\":\"password\",\"accounts\":["
-	for i := range len(outbound_cfgs) {
-		cfg += fmt.Sprintf("{\"user\":\"ob_%d\",\"pass\":\"1\"}", i)
-		if i != len(outbound_cfgs)-1 {
+	for i, tag := range tags {
+		cfg += fmt.Sprintf("{\"user\":\"%s\",\"pass\":\"1\"}", tag)
+		if i != len(tags)-1 {
 			cfg += ","
 		}
 	}
 	cfg += "],\"udp\":true}}],\"outbounds\":["
-	for i, ob := range outbound_cfgs {
-		cfg += strings.Replace(ob, "\"tag\":\"\"", fmt.Sprintf("\"tag\":\"ob_%d\"", i), 1)
-		if i != len(outbound_cfgs)-1 {
+	for i, tag := range tags {
+		cfg += strings.Replace(outbounds[tag], "\"tag\":\"\"", fmt.Sprintf("\"tag\":\"%s\"", tag), 1)
+		if i != len(tags)-1 {
 			cfg += ","
 		}
 	}
 	cfg += "],\"routing\":{\"domainStrategy\":\"AsIs\",\"rules\":["
-	for i := range len(outbound_cfgs) {
-		c_ob := fmt.Sprintf("ob_%d", i)
-		cfg += "{\"type\":\"field\",\"user\":[\"" + c_ob + "\"],\"outboundTag\":\"" + c_ob + "\"}"
-		if i != len(outbound_cfgs)-1 {
+	for i, tag := range tags {
+		cfg += "{\"type\":\"field\",\"user\":[\"" + tag + "\"],\"outboundTag\":\"" + tag + "\"}"
+		if i != len(tags)-1 {
 			cfg += ","
 		}
 	}
@@ -120,56 +122,140 @@ func launchXray(outbound_cfgs []string) int {
 	cfg = regexp.MustCompile(`"[a-zA-Z]+": ?{},?`).ReplaceAllString(cfg, "")
 	cfg = regexp.MustCompile(`,}`).ReplaceAllString(cfg, "}")
 
-	err = xray.RunXrayFromJSON("", cfg)
-	if err != nil {
-		panic(err)
+	if err := xray.RunXrayFromJSON("", cfg); err != nil {
+		return 0, err
 	}
+	xrayLaunched.Store(true)
+	return port, nil
+}
 
-	return free_port
+// the embedded xray instance is one per process, managers share it: it runs the
+// outbounds each of them needs
+var (
+	xrayMu        sync.Mutex
+	xrayPort      int                                 // of the socks inbound, kept across relaunches
+	xrayOutbounds map[string]string                   // outbounds the running xray has by tag
+	xrayOwners    map[*ProxyManager]map[string]string // outbounds each manager needs by tag
+)
+
+// identifies an outbound without revealing it. outbounds are marshalled by
+// shareLinkProxy, so the same link always gives the same one
+func outboundID(outbound string) string {
+	sum := sha256.Sum256([]byte(outbound))
+	return hex.EncodeToString(sum[:8])
 }
 
-func (pm *ProxyManager) ParseFile(filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
+// tag of an outbound in the xray config and the username reaching it
+func xrayTag(outbound string) string {
+	return "ob_" + outboundID(outbound)
+}
+
+// makes xray run an outbound for each XRAY proxy the manager will have once proxies
+// are the list of source name, and gives XRAY proxies in proxies their addresses.
+// the port and usernames stay the same across relaunches, so proxies already in
+// managers keep theirs. xray is relaunched only when it lacks some outbound (the ones
+// no longer needed are dropped then), if it fails xray keeps running as it was and
+// the error is returned
+func (pm *ProxyManager) syncXray(name string, proxies []*Proxy) error {
+	mine := make(map[string]string)
+	pm.cond.L.Lock()
+	for key, prx := range pm.byKey {
+		if _, listed := pm.sources[name][key]; prx.Proto == XRAY && (!listed || pm.listedElsewhere(name, key)) {
+			mine[xrayTag(prx.Outbound)] = prx.Outbound
+		}
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	lineNumber := 0
-	xray_ob_cfgs := []string{}
-	for scanner.Scan() {
-		lineNumber++
-		line := scanner.Text()
-		line, _, _ = strings.Cut(line, "#")
-		line = strings.TrimSpace(line)
-		addr, prot, err := parseLine(line)
-		if err {
-			logging.Warn(fmt.Sprintf("unknown proto in %s, line %d", filename, lineNumber))
-			continue
+	for _, prx := range proxies {
+		if _, dropped := pm.dropped[prx.key()]; prx.Proto == XRAY && !dropped {
+			mine[xrayTag(prx.Outbound)] = prx.Outbound
 		}
+	}
+	pm.cond.L.Unlock()
 
-		if prot != XRAY {
-			if !isValidAddress(addr) {
-				logging.Warn(fmt.Sprintf("invalid addr format in %s, line %d", filename, lineNumber))
-				continue
+	xrayMu.Lock()
+	defer xrayMu.Unlock()
+	relaunch := false
+	for tag := range mine {
+		if _, ok := xrayOutbounds[tag]; !ok {
+			relaunch = true
+			break
+		}
+	}
+	if relaunch {
+		outbounds := maps.Clone(mine)
+		for owner, theirs := range xrayOwners {
+			if owner != pm {
+				maps.Copy(outbounds, theirs)
 			}
-
-			pm.AddProxy(addr, prot)
-		} else {
-			xray_ob_cfgs = append(xray_ob_cfgs, addr)
+		}
+		if err := pm.relaunchXray(outbounds); err != nil {
+			return err
 		}
 	}
+	if len(mine) != 0 {
+		if xrayOwners == nil {
+			xrayOwners = make(map[*ProxyManager]map[string]string)
+		}
+		xrayOwners[pm] = mine
+	} else {
+		delete(xrayOwners, pm)
+	}
+	for _, prx := range proxies {
+		if prx.Proto == XRAY {
+			prx.Address = fmt.Sprintf("%d:%s", xrayPort, xrayTag(prx.Outbound))
+		}
+	}
+	return nil
+}
 
-	if len(xray_ob_cfgs) != 0 {
-		port := launchXray(xray_ob_cfgs)
-		for i := range len(xray_ob_cfgs) {
-			pm.AddProxy(fmt.Sprintf("%d:ob_%d", port, i), XRAY)
+// (re)launches xray with outbounds, if it fails xray is launched again with the
+// outbounds it had. xrayMu must be held
+func (pm *ProxyManager) relaunchXray(outbounds map[string]string) error {
+	prev := xrayOutbounds
+	if xrayLaunched.Load() {
+		pm.Logger().Warn("relaunching xray, connections through it will break", "outbounds", len(outbounds))
+		if err := pm.stopXray(); err != nil {
+			return fmt.Errorf("stopping xray: %w", err)
+		}
+	}
+	port, err := launchXray(xrayPort, outbounds)
+	if err != nil {
+		if len(prev) != 0 {
+			if _, rerr := launchXray(xrayPort, prev); rerr != nil {
+				pm.Logger().Error("unable to launch xray again with the previous outbounds", "error", rerr)
+			} else {
+				xrayOutbounds = prev
+			}
 		}
+		return fmt.Errorf("launching xray: %w", err)
+	}
+	xrayPort, xrayOutbounds = port, outbounds
+	return nil
+}
+
+// StopXray tells that the manager no longer needs the embedded xray instance, which
+// is stopped once no manager does
+func (pm *ProxyManager) StopXray() {
+	xrayMu.Lock()
+	defer xrayMu.Unlock()
+	delete(xrayOwners, pm)
+	if len(xrayOwners) != 0 {
+		return
 	}
+	if err := pm.stopXray(); err != nil {
+		pm.Logger().Error("unable to stop xray", "error", err)
+	}
+}
 
-	if err := scanner.Err(); err != nil {
+// stops xray if it was launched, xrayMu must be held
+func (pm *ProxyManager) stopXray() error {
+	if !xrayLaunched.Load() {
+		return nil
+	}
+	if err := xray.StopXray(); err != nil {
 		return err
 	}
+	xrayLaunched.Store(false)
+	xrayOutbounds = nil
+	pm.Logger().Info("xray stopped")
 	return nil
 }
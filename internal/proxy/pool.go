@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// an entry of a pool file, json uses the same keys
+type poolEntry struct {
+	URL      string   `yaml:"url"`   // proxy url or share link
+	Proto    string   `yaml:"proto"` // protocol of the url if it has no scheme, overrides the list's one
+	User     string   `yaml:"user"`
+	Pass     string   `yaml:"pass"`
+	Weight   float64  `yaml:"weight"`
+	Tags     []string `yaml:"tags"`
+	MaxConns int      `yaml:"maxconns"`
+	Check    struct {
+		URL      string        `yaml:"url"`
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"check"`
+	Disabled bool `yaml:"disabled"`
+}
+
+// a pool file: options in defaults apply to every entry which doesn't set them
+type poolFile struct {
+	Defaults poolEntry   `yaml:"defaults"`
+	Pool     []poolEntry `yaml:"pool"`
+}
+
+// reads a pool file (yaml or json, which yaml covers)
+func parsePool(data []byte, l *list) error {
+	var pf poolFile
+	if err := yaml.Unmarshal(data, &pf); err != nil {
+		return err
+	}
+	if pf.Pool == nil {
+		return errors.New("no pool list")
+	}
+
+	for i, e := range pf.Pool {
+		entry := fmt.Sprintf("entry %d", i+1)
+		e.inherit(pf.Defaults)
+		if e.Disabled {
+			l.log.Debug("proxy is disabled", "file", l.name, "entry", entry, "url", e.URL)
+			continue
+		}
+		prx, err := e.proxy(l.proto)
+		if err != nil {
+			l.bad(0, entry, err)
+			continue
+		}
+		l.add(prx, 0, entry)
+	}
+	return nil
+}
+
+// fills options which aren't set from defaults, tags are merged
+func (e *poolEntry) inherit(defaults poolEntry) {
+	if e.Proto == "" {
+		e.Proto = defaults.Proto
+	}
+	if e.User == "" && e.Pass == "" {
+		e.User, e.Pass = defaults.User, defaults.Pass
+	}
+	if e.Weight == 0 {
+		e.Weight = defaults.Weight
+	}
+	if e.MaxConns == 0 {
+		e.MaxConns = defaults.MaxConns
+	}
+	if e.Check.URL == "" {
+		e.Check.URL = defaults.Check.URL
+	}
+	if e.Check.Interval == 0 {
+		e.Check.Interval = defaults.Check.Interval
+	}
+	e.Tags = append(append([]string(nil), defaults.Tags...), e.Tags...)
+	e.Disabled = e.Disabled || defaults.Disabled
+}
+
+// makes the entry's proxy, proto is the list's protocol of urls without a scheme
+func (e *poolEntry) proxy(proto string) (*Proxy, error) {
+	if e.Weight < 0 || e.MaxConns < 0 || e.Check.Interval < 0 {
+		return nil, errors.New("negative option")
+	}
+	if e.Proto != "" {
+		proto = e.Proto
+	}
+	prx, err := parseLink(e.URL, proto)
+	if err != nil {
+		return nil, err
+	}
+	if e.User != "" {
+		prx.User, prx.Pass = e.User, e.Pass
+	}
+	prx.Weight = e.Weight
+	prx.MaxConns = e.MaxConns
+	if e.Check.URL != "" || e.Check.Interval != 0 {
+		prx.Check = &CheckOptions{URL: e.Check.URL, Interval: e.Check.Interval}
+	}
+	if len(e.Tags) != 0 {
+		prx.Tags = e.Tags
+	}
+	return prx, nil
+}
+
+// credentials part of a key: "user:hash@", hash being of the password as keys are
+// saved to the state file. empty without credentials
+func credentialsKey(user string, pass string) string {
+	if user == "" && pass == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(pass))
+	return url.PathEscape(user) + ":" + hex.EncodeToString(sum[:8]) + "@"
+}
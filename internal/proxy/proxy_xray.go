@@ -27,13 +27,60 @@ const (
 	XRAY
 )
 
+func (p Protocol) String() string {
+	switch p {
+	case HTTP:
+		return "http"
+	case HTTPS:
+		return "https"
+	case SOCKS4:
+		return "socks4"
+	case SOCKS5:
+		return "socks5"
+	case XRAY:
+		return "xray"
+	}
+	return "unknown"
+}
+
 type Proxy struct {
-	Address string
-	Proto   Protocol
+	Address    string
+	Proto      Protocol
+	Outbound   string        // xray outbound config (json) of XRAY proxies
+	Link       string        // share link XRAY proxies were made of
+	User, Pass string        // credentials the proxy wants, empty if none
+	Weight     float64       // ranking score is divided by it, 0 means 1
+	MaxConns   int           // overrides the manager's per-proxy cap, 0 means no override
+	Check      *CheckOptions // overrides of how the proxy is checked, nil means none
+	Tags       []string      // labels given by the source the proxy came from
+}
+
+// identifies the proxy across reloads and restarts: the same address with other
+// credentials (e.g. sessions of a vendor's gateway) is another proxy. xray proxies
+// are told apart by their outbound config instead, which has their credentials,
+// so a hash of it is used as keys are saved to the state file
+func (p *Proxy) key() string {
+	if p.Proto == XRAY {
+		return p.Proto.String() + "://" + outboundID(p.Outbound)
+	}
+	return p.Proto.String() + "://" + credentialsKey(p.User, p.Pass) + p.Address
+}
+
+// CheckOptions override how the checker treats a proxy
+type CheckOptions struct {
+	URL      string        // fetched through the proxy instead of the default check, 2xx is success
+	Interval time.Duration // how often the proxy is checked instead of PRXCHKCD
 }
 
 type proxyStats struct {
-	handshakeAvg time.Duration
-	errors       uint8
-	lastErr      string
+	latency     latency
+	throughput  float64 // bytes per second, 0 if never measured
+	lastBWProbe time.Time
+	exitIP      string
+	lastIPProbe time.Time
+	lastCheck   time.Time
+	checkGiven  time.Time // when the proxy was last leased for a check
+	brk         breaker
+	lastErr     string
+	inFlight    int // how many relay leases of the proxy are held
 }
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"os"
+)
+
+// SetSource makes proxies the list of proxies coming from source name: new ones are
+// added, ones which were listed before but aren't anymore are removed unless another
+// source still lists them. proxies already in the manager are kept as they are
+// (with their tags). returns how many proxies were added and removed. if xray can't
+// be launched for the XRAY proxies, the manager is left as it was
+func (pm *ProxyManager) SetSource(name string, proxies []*Proxy) (added int, removed int, err error) {
+	pm.srcMu.Lock()
+	defer pm.srcMu.Unlock()
+	if err := pm.syncXray(name, proxies); err != nil {
+		return 0, 0, err
+	}
+
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+
+	keys := make(map[string]struct{}, len(proxies))
+	for _, prx := range proxies {
+		key := prx.key()
+		keys[key] = struct{}{}
+		if _, dropped := pm.dropped[key]; dropped {
+			continue
+		}
+		if pm.addLocked(prx) {
+			added++
+		}
+	}
+	for key := range pm.sources[name] {
+		if _, still := keys[key]; still || pm.listedElsewhere(name, key) {
+			continue
+		}
+		if prx, ok := pm.byKey[key]; ok {
+			pm.removeLocked(prx)
+			removed++
+		}
+	}
+	pm.sources[name] = keys
+
+	pm.cond.Broadcast()
+	return added, removed, nil
+}
+
+// tells if a source other than name lists key. pm.cond.L must be held
+func (pm *ProxyManager) listedElsewhere(name string, key string) bool {
+	for src, keys := range pm.sources {
+		if _, ok := keys[key]; ok && src != name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFile adds proxies from a file in any of the list formats, guessing which one it
+// is unless opts tell. the file is a source named after it, so it can be reread later
+// with the same name
+func (pm *ProxyManager) ParseFile(filename string, opts ParseOptions) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	opts.Name = filename
+	proxies, err := Parse(data, opts)
+	if err != nil {
+		return err
+	}
+	_, _, err = pm.SetSource(filename, proxies)
+	return err
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+)
+
+const stateVersion = 1
+
+type savedState struct {
+	Version int          `json:"version"`
+	Saved   time.Time    `json:"saved"`
+	Proxies []savedProxy `json:"proxies"`
+}
+
+type savedProxy struct {
+	Key        string          `json:"key"`
+	Bad        bool            `json:"bad"`
+	Latency    time.Duration   `json:"latency"`
+	Samples    uint64          `json:"samples"`
+	Window     []time.Duration `json:"window,omitempty"`
+	Throughput float64         `json:"throughput,omitempty"`
+	ExitIP     string          `json:"exit_ip,omitempty"`
+	LastCheck  time.Time       `json:"last_check"`
+	LastErr    string          `json:"last_err,omitempty"`
+	Breaker    savedBreaker    `json:"breaker"`
+}
+
+type savedBreaker struct {
+	State     breakerState  `json:"state"`
+	Window    []uint8       `json:"window,omitempty"`
+	OpenedAt  time.Time     `json:"opened_at"`
+	Until     time.Time     `json:"until"`
+	Cooldown  time.Duration `json:"cooldown,omitempty"`
+	Successes uint8         `json:"successes,omitempty"`
+}
+
+func newSavedProxy(prx *Proxy, stats proxyStats, bad bool) savedProxy {
+	// windows are saved oldest first, so they don't need the ring position
+	lat := stats.latency
+	brk := stats.brk
+	return savedProxy{
+		Key:        prx.key(),
+		Bad:        bad,
+		Latency:    lat.ewma,
+		Samples:    lat.samples,
+		Window:     slices.Concat(lat.window[lat.next:], lat.window[:lat.next]),
+		Throughput: stats.throughput,
+		ExitIP:     stats.exitIP,
+		LastCheck:  stats.lastCheck,
+		LastErr:    stats.lastErr,
+		Breaker: savedBreaker{
+			State:     brk.state,
+			Window:    slices.Concat(brk.window[brk.next:], brk.window[:brk.next]),
+			OpenedAt:  brk.openedAt,
+			Until:     brk.until,
+			Cooldown:  brk.cooldown,
+			Successes: brk.successes,
+		},
+	}
+}
+
+// returns the statistics saved in sp, brkWindow is the breaker window size now.
+// windows saved with a bigger size (of an older run) keep their newest entries
+func (sp savedProxy) stats(brkWindow int) proxyStats {
+	stats := proxyStats{
+		latency: latency{
+			ewma:    sp.Latency,
+			samples: sp.Samples,
+			window:  newest(sp.Window, constants.PRXLATWINDOW),
+		},
+		throughput: sp.Throughput,
+		exitIP:     sp.ExitIP,
+		lastCheck:  sp.LastCheck,
+		lastErr:    sp.LastErr,
+		brk: breaker{
+			state:     sp.Breaker.State,
+			window:    newest(sp.Breaker.Window, brkWindow),
+			openedAt:  sp.Breaker.OpenedAt,
+			until:     sp.Breaker.Until,
+			cooldown:  sp.Breaker.Cooldown,
+			successes: sp.Breaker.Successes,
+		},
+	}
+	if sp.Bad && stats.brk.state == closed {
+		stats.brk.state = open
+	} else if !sp.Bad {
+		stats.brk.state = closed
+	}
+	return stats
+}
+
+// returns the last n entries of a window saved oldest first
+func newest[T any](window []T, n int) []T {
+	if len(window) <= n {
+		return window
+	}
+	return slices.Clone(window[len(window)-n:])
+}
+
+// LoadState reads a state saved by SaveState. it must be called before adding
+// proxies: a proxy gets its saved statistics when it is added. missing file is not an error
+func (pm *ProxyManager) LoadState(filename string) error {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", state.Version)
+	}
+
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	pm.restored = make(map[string]savedProxy, len(state.Proxies))
+	for _, sp := range state.Proxies {
+		pm.restored[sp.Key] = sp
+	}
+	pm.Logger().Info("loaded state", "file", filename, "proxies", len(state.Proxies), "saved", state.Saved)
+	return nil
+}
+
+// SaveState writes statistics of all proxies to filename (atomically)
+func (pm *ProxyManager) SaveState(filename string) error {
+	pm.cond.L.Lock()
+	state := savedState{
+		Version: stateVersion,
+		Saved:   time.Now(),
+		Proxies: make([]savedProxy, 0, len(pm.proxies)+len(pm.badProxies)),
+	}
+	for prx, stats := range pm.proxies {
+		state.Proxies = append(state.Proxies, newSavedProxy(prx, stats, false))
+	}
+	for prx, stats := range pm.badProxies {
+		state.Proxies = append(state.Proxies, newSavedProxy(prx, stats, true))
+	}
+	pm.cond.L.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// periodically saves the state to filename until ctx is done
+func (pm *ProxyManager) ServeStateSaver(ctx context.Context, filename string, every time.Duration) {
+	for sleepCtx(ctx, every) {
+		if err := pm.SaveState(filename); err != nil {
+			pm.Logger().Error("unable to save state", "file", filename, "error", err)
+		}
+	}
+}
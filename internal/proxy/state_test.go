@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+)
+
+// statistics saved by one manager are given to the same proxies added to another
+func TestStateRoundTrip(t *testing.T) {
+	good := &Proxy{Address: "203.0.113.1:1080", Proto: SOCKS5, User: "alice", Pass: "secret"}
+	bad := &Proxy{Address: "203.0.113.2:8080", Proto: HTTP}
+	pm := newTestManager()
+	pm.SetSource("s", []*Proxy{good, bad})
+
+	now := time.Now().Round(0)
+	pm.cond.L.Lock()
+	stats := pm.proxies[good]
+	for _, d := range []time.Duration{30, 10, 20} {
+		stats.latency.add(d*time.Millisecond, 0.5)
+	}
+	stats.throughput = 1 << 20
+	stats.exitIP = "198.51.100.1"
+	stats.lastCheck = now
+	stats.brk.record(0, pm.brkWindow)
+	stats.brk.record(1, pm.brkWindow)
+	pm.proxies[good] = stats
+	badStats := pm.proxies[bad]
+	delete(pm.proxies, bad)
+	pm.rmFromSorted(bad)
+	badStats.lastErr = "refused: connection refused"
+	badStats.brk.trip(now, time.Minute)
+	pm.badProxies[bad] = badStats
+	pm.cond.L.Unlock()
+
+	file := filepath.Join(t.TempDir(), "state.json")
+	if err := pm.SaveState(file); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Error("the state file has the password")
+	}
+
+	restored := newTestManager()
+	if err := restored.LoadState(file); err != nil {
+		t.Fatal(err)
+	}
+	other := &Proxy{Address: "203.0.113.1:1080", Proto: SOCKS5, User: "alice", Pass: "other"}
+	restored.SetSource("s", []*Proxy{
+		{Address: "203.0.113.1:1080", Proto: SOCKS5, User: "alice", Pass: "secret"},
+		{Address: "203.0.113.2:8080", Proto: HTTP},
+		// another session of the same gateway is another proxy
+		other,
+	})
+	tests := []struct {
+		prx     *Proxy
+		state   breakerState
+		samples uint64
+		p50     time.Duration
+		exitIP  string
+		lastErr string
+	}{
+		{good, closed, 3, 20 * time.Millisecond, "198.51.100.1", ""},
+		{bad, open, 0, 0, "", "refused: connection refused"},
+		{other, closed, 0, 0, "", ""},
+	}
+	restored.cond.L.Lock()
+	defer restored.cond.L.Unlock()
+	for _, tt := range tests {
+		prx := restored.byKey[tt.prx.key()]
+		got, ok := restored.proxies[prx]
+		if !ok {
+			got, ok = restored.badProxies[prx]
+		}
+		if !ok {
+			t.Errorf("%s is missing", tt.prx.key())
+			continue
+		}
+		if got.brk.state != tt.state || got.latency.samples != tt.samples || got.latency.percentile(0.5) != tt.p50 ||
+			got.exitIP != tt.exitIP || got.lastErr != tt.lastErr {
+			t.Errorf("%s: restored as %+v", tt.prx.key(), got)
+		}
+	}
+
+	got := restored.proxies[restored.byKey[good.key()]]
+	if got.latency.ewma != stats.latency.ewma || got.throughput != stats.throughput ||
+		!got.lastCheck.Equal(now) || !slices.Equal(got.brk.window, stats.brk.window) {
+		t.Errorf("restored %+v, saved %+v", got, stats)
+	}
+	gotBad := restored.badProxies[restored.byKey[bad.key()]]
+	if !gotBad.brk.until.Equal(badStats.brk.until) || gotBad.brk.cooldown != time.Minute {
+		t.Errorf("restored breaker %+v, saved %+v", gotBad.brk, badStats.brk)
+	}
+}
+
+// windows saved with a bigger size than the current one keep their newest entries
+func TestStateTrimsWindows(t *testing.T) {
+	prx := &Proxy{Address: "203.0.113.1:1080", Proto: SOCKS5}
+	tests := []struct {
+		saved []uint8
+		size  int
+		want  []uint8
+	}{
+		{[]uint8{1, 0, 2, 0, 0, 1}, 4, []uint8{2, 0, 0, 1}},
+		{[]uint8{1, 0, 2}, 4, []uint8{1, 0, 2}},
+		{[]uint8{1, 0}, 1, []uint8{0}},
+	}
+	for _, tt := range tests {
+		sp := savedProxy{Key: prx.key(), Breaker: savedBreaker{Window: tt.saved}}
+		for i := range constants.PRXLATWINDOW + 5 {
+			sp.Window = append(sp.Window, time.Duration(i))
+		}
+		pm := newTestManager()
+		pm.SetBreaker(tt.size, tt.size, 1, time.Minute)
+		pm.restored = map[string]savedProxy{sp.Key: sp}
+		pm.addProxy(prx)
+
+		stats := pm.proxies[prx]
+		if !slices.Equal(stats.brk.window, tt.want) {
+			t.Errorf("saved %v, size %d: window %v, want %v", tt.saved, tt.size, stats.brk.window, tt.want)
+		}
+		if len(stats.latency.window) != constants.PRXLATWINDOW || stats.latency.window[0] != 5 {
+			t.Errorf("latency window of %d starting with %v", len(stats.latency.window), stats.latency.window[0])
+		}
+		// the trimmed window goes on as a full ring
+		stats.brk.record(3, pm.brkWindow)
+		if len(stats.brk.window) != min(len(tt.saved)+1, tt.size) {
+			t.Errorf("saved %v, size %d: window %v after a record", tt.saved, tt.size, stats.brk.window)
+		}
+	}
+}
@@ -12,15 +12,17 @@
 package proxy
 
 import (
-	"math/rand"
+	"context"
+	"log/slog"
 	"slices"
 	"sort"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/etidart/proxyflow/internal/constants"
 	"github.com/etidart/proxyflow/internal/logging"
+	"github.com/etidart/proxyflow/internal/metrics"
 )
 
 type ProxyManager struct {
@@ -28,6 +30,30 @@ type ProxyManager struct {
 	proxies       map[*Proxy]proxyStats
 	badProxies    map[*Proxy]proxyStats
 	sortedProxies []*Proxy
+
+	bwWeight     float64       // how much throughput matters in ranking, 0 means latency only
+	bwProbeEvery time.Duration // how often each proxy should get a bandwidth probe, 0 means never
+	ipProbeEvery time.Duration // how often each proxy's exit ip should be learned, 0 means never
+	ewmaAlpha    float64       // weight of a new sample in the latency and throughput estimates
+	penalties    Penalties     // what weight each error class has in breaker's failure rate
+
+	brkWindow     int           // how many last outcomes each breaker keeps
+	brkMinSamples int           // how many outcomes are needed before a breaker can trip
+	brkFailRate   float64       // failure rate which trips a breaker
+	brkCooldown   time.Duration // first cooldown of an open breaker
+	promoteAfter  uint8         // how many successful trials in a row close a breaker
+	maxDead       time.Duration // how long a proxy may stay bad before it is dropped, 0 means forever
+
+	maxInFlight int // how many relays a proxy can serve at once, 0 means unlimited
+
+	restored map[string]savedProxy // loaded state of proxies which weren't added yet (or were removed)
+
+	byKey   map[string]*Proxy              // every proxy in the manager by its key
+	sources map[string]map[string]struct{} // keys of proxies listed by each source
+	dropped map[string]struct{}            // keys of proxies dropped for being dead, sources can't bring them back
+	srcMu   sync.Mutex                     // serializes SetSource calls, taken before cond.L
+
+	log atomic.Pointer[slog.Logger] // what the manager logs to, nil is the default logger
 }
 
 // NewProxyManager initializes a new ProxyManager
@@ -35,188 +61,375 @@ func NewProxyManager() *ProxyManager {
 	return &ProxyManager{
 		proxies:    make(map[*Proxy]proxyStats),
 		badProxies: make(map[*Proxy]proxyStats),
+		byKey:      make(map[string]*Proxy),
+		sources:    make(map[string]map[string]struct{}),
+		dropped:    make(map[string]struct{}),
 		cond:       *sync.NewCond(&sync.Mutex{}),
+		ewmaAlpha:  constants.PRXEWMAALPHA,
+		penalties:  DefaultPenalties(),
+
+		brkWindow:     constants.PRXBRKWINDOW,
+		brkMinSamples: constants.PRXBRKMINSAMPLES,
+		brkFailRate:   constants.PRXBRKFAILRATE,
+		brkCooldown:   constants.PRXBRKCD,
+		promoteAfter:  constants.PRXPROMOTESUCC,
+		maxDead:       constants.PRXMAXDEAD,
+	}
+}
+
+// SetLogger makes the manager and the checkers of its proxies log to l instead of
+// the default logger, for programs running several managers
+func (pm *ProxyManager) SetLogger(l *slog.Logger) {
+	pm.log.Store(l)
+}
+
+// Logger returns what the manager logs to
+func (pm *ProxyManager) Logger() *slog.Logger {
+	if l := pm.log.Load(); l != nil {
+		return l
 	}
+	return logging.Logger()
+}
+
+// SetPenalties sets the weight of each error class in breakers' failure rate
+func (pm *ProxyManager) SetPenalties(p Penalties) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	pm.penalties = p
 }
 
-type Message struct {
-	Prx *Proxy
-	Err string
-	Dur time.Duration
+// SetLatencyAlpha sets the weight (0..1] of a new sample in the latency and throughput
+// estimates
+func (pm *ProxyManager) SetLatencyAlpha(alpha float64) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	pm.ewmaAlpha = alpha
+}
+
+// SetThroughputRanking configures bandwidth-aware ranking. weight scales the
+// estimated transfer time of PRXBWREFSIZE bytes that is added to the latency
+// (0 ranks by latency only), probeEvery is how often check leases ask for
+// a bandwidth probe of each proxy (0 disables probes)
+func (pm *ProxyManager) SetThroughputRanking(weight float64, probeEvery time.Duration) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	pm.bwWeight = weight
+	pm.bwProbeEvery = probeEvery
+	pm.sortProxies()
+}
+
+// SetExitIPProbing sets how often check leases ask to learn each proxy's exit ip (0 disables)
+func (pm *ProxyManager) SetExitIPProbing(every time.Duration) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	pm.ipProbeEvery = every
+}
+
+// SetMaxConns sets how many relays a proxy can serve at once (0 is unlimited).
+// saturated proxies aren't given for relays
+func (pm *ProxyManager) SetMaxConns(n int) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	pm.maxInFlight = n
 }
 
-// serves as channel receiving machine
-func (pm *ProxyManager) ServeProxies(requests <-chan chan Message) {
-	for {
-		req := <-requests
-		prx := pm.getBestProxy()
-		req <- Message{Prx: prx}
+// how often prx is checked
+func checkInterval(prx *Proxy) time.Duration {
+	if prx.Check != nil && prx.Check.Interval != 0 {
+		return prx.Check.Interval
+	}
+	return constants.PRXCHKCD
+}
 
-		go func() {
-			ans := <-req
-			if ans.Err != "" {
-				pm.addError(ans.Prx, ans.Err)
-			} else if ans.Dur != 0 {
-				pm.changeHandshakeAvg(ans.Prx, ans.Dur)
-			}
-		}()
+// sleeps for d, returns false if ctx got done earlier
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
-// same as ServeProxies() but gives not the best, but random proxy
-func (pm *ProxyManager) ServeChecker(requests <-chan chan Message) {
-	alreadyChecking := make(map[*Proxy]time.Time)
-	for {
-		pm.cond.L.Lock()
-		for len(pm.sortedProxies) == 0 {
-			pm.cond.Wait()
+// appends a proxy to manager, restoring its state if there is a saved one
+func (pm *ProxyManager) addProxy(proxy *Proxy) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	pm.addLocked(proxy)
+	pm.cond.Broadcast()
+}
+
+// appends a proxy to manager unless there is one with the same key. pm.cond.L must be held
+func (pm *ProxyManager) addLocked(proxy *Proxy) bool {
+	key := proxy.key()
+	if _, exists := pm.byKey[key]; exists {
+		return false
+	}
+	pm.byKey[key] = proxy
+
+	if saved, ok := pm.restored[key]; ok {
+		delete(pm.restored, key)
+		stats := saved.stats(pm.brkWindow)
+		if saved.Bad {
+			pm.badProxies[proxy] = stats
+			return true
 		}
-		proxyCopy := make([]*Proxy, len(pm.sortedProxies))
-		copy(proxyCopy, pm.sortedProxies)
-		pm.cond.L.Unlock()
-
-		rand.Shuffle(len(proxyCopy), func(i, j int) {
-			proxyCopy[i], proxyCopy[j] = proxyCopy[j], proxyCopy[i]
-		})
-
-		// for further deletion from alreadyChecking
-		lookup := make(map[*Proxy]struct{})
-
-		for _, proxy := range proxyCopy {
-			lookup[proxy] = struct{}{}
-
-			req := <-requests
-			tval, isIn := alreadyChecking[proxy]
-			var good bool
-			if !isIn {
-				alreadyChecking[proxy] = time.Now()
-				good = true
-			} else {
-				if time.Since(tval) < constants.PRXCHKCD {
-					good = false
-				} else {
-					alreadyChecking[proxy] = time.Now()
-					good = true
-				}
-			}
-
-			if good {
-				req <- Message{Prx: proxy}
-				go func() {
-					ans := <-req
-					if ans.Err != "" {
-						pm.addError(ans.Prx, ans.Err)
-					} else if ans.Dur != 0 {
-						pm.changeHandshakeAvg(ans.Prx, ans.Dur)
-					}
-				}()
-			}
+		pm.proxies[proxy] = stats
+	} else {
+		pm.proxies[proxy] = proxyStats{
+			latency: newLatency(constants.PRXDEFHSAVG),
 		}
+	}
+	pm.sortedProxies = append(pm.sortedProxies, proxy)
+	pm.sortProxies()
+	return true
+}
 
-		// cleanup alreadyChecking using lookup
-		for key := range alreadyChecking {
-			if _, found := lookup[key]; !found {
-				delete(alreadyChecking, key)
-			}
-		}
+// removes a proxy from manager, its state is kept in case it comes back. pm.cond.L must be held
+func (pm *ProxyManager) removeLocked(proxy *Proxy) {
+	stats, bad := pm.badProxies[proxy]
+	if !bad {
+		stats = pm.proxies[proxy]
+	}
+	if pm.restored == nil {
+		pm.restored = make(map[string]savedProxy)
+	}
+	pm.restored[proxy.key()] = newSavedProxy(proxy, stats, bad)
+	delete(pm.proxies, proxy)
+	delete(pm.badProxies, proxy)
+	delete(pm.byKey, proxy.key())
+	pm.rmFromSorted(proxy)
+	pm.forgetMetrics(proxy)
+}
 
-		// optimize by sleeping
-		var earlistTime time.Time
-		for _, t := range alreadyChecking {
-			if earlistTime.IsZero() || t.Before(earlistTime) {
-				earlistTime = t
-			}
+// deletes metrics series of a proxy which is gone, unless another proxy has them
+// too (the same address with other credentials). pm.cond.L must be held
+func (pm *ProxyManager) forgetMetrics(prx *Proxy) {
+	for _, other := range pm.byKey {
+		if other.Address == prx.Address && other.Proto == prx.Proto {
+			return
 		}
-		time.Sleep(constants.PRXCHKCD - time.Since(earlistTime))
 	}
+	metrics.Handshakes.Delete(prx.Address, prx.Proto.String())
 }
 
-// appends a proxy to manager with specified handshakeAvg
-func (pm *ProxyManager) addProxyHS(addr string, prot Protocol, hsavg time.Duration) {
-	proxy := &Proxy{
+// appends a proxy to manager
+func (pm *ProxyManager) AddProxy(addr string, prot Protocol) {
+	pm.addProxy(&Proxy{
 		Address: addr,
 		Proto:   prot,
+	})
+}
+
+// applies a result of using prx reported by the checker or the server. prx is the
+// leased one, the manager may hold another *Proxy for it by now (see resolve)
+func (pm *ProxyManager) handleResult(prx *Proxy, res Result) {
+	if res.Err == nil && res.Dur != 0 {
+		pm.observeHandshake(prx, res.Dur)
 	}
-	pm.proxies[proxy] = proxyStats{
-		handshakeAvg: hsavg,
-		errors:       0,
+	if pm.handleTrial(prx, res) {
+		return
+	}
+	if res.Err != nil {
+		pm.addError(prx, res.Err)
+		return
+	}
+	if res.Dur != 0 {
+		pm.addSuccess(prx, res.Dur)
+	}
+	if res.Tput != 0 {
+		pm.changeThroughput(prx, res.Tput)
 	}
-	pm.sortedProxies = append(pm.sortedProxies, proxy)
-	pm.sortProxies()
 }
 
-// appends a proxy to manager
-func (pm *ProxyManager) AddProxy(addr string, prot Protocol) {
+// adds a handshake time to the metrics of prx, unless it is gone: its series
+// would outlive it otherwise
+func (pm *ProxyManager) observeHandshake(prx *Proxy, d time.Duration) {
 	pm.cond.L.Lock()
 	defer pm.cond.L.Unlock()
-	pm.addProxyHS(addr, prot, constants.PRXDEFHSAVG)
+	if pm.resolve(prx) != nil {
+		metrics.Handshakes.Observe(d.Seconds(), prx.Address, prx.Proto.String())
+	}
+}
+
+// reports whether proxy should get a bandwidth probe and an exit ip probe now (and marks
+// it as probed). pm.cond.L must be held
+func (pm *ProxyManager) probesDue(prx *Proxy) (bw bool, ip bool) {
+	stats, exists := pm.proxies[prx]
+	if !exists {
+		return false, false
+	}
+	now := time.Now()
+	if pm.bwProbeEvery != 0 && now.Sub(stats.lastBWProbe) >= pm.bwProbeEvery {
+		stats.lastBWProbe = now
+		bw = true
+	}
+	if pm.ipProbeEvery != 0 && now.Sub(stats.lastIPProbe) >= pm.ipProbeEvery {
+		stats.lastIPProbe = now
+		ip = true
+	}
+	pm.proxies[prx] = stats
+	return bw, ip
 }
 
-// update the handshakeAvg
-func (pm *ProxyManager) changeHandshakeAvg(prx *Proxy, newVal time.Duration) {
+// remembers when proxy was checked and what exit ip it has
+func (pm *ProxyManager) markChecked(prx *Proxy, res Result) {
 	pm.cond.L.Lock()
 	defer pm.cond.L.Unlock()
 
+	if prx = pm.resolve(prx); prx == nil {
+		return
+	}
+	m := pm.proxies
+	stats, exists := m[prx]
+	if !exists {
+		m = pm.badProxies
+		if stats, exists = m[prx]; !exists {
+			return
+		}
+	}
+	stats.lastCheck = time.Now()
+	if res.ExitIP != "" {
+		stats.exitIP = res.ExitIP
+	}
+	m[prx] = stats
+}
+
+// feed a throughput sample to the estimate, which is an ewma as the latency one is
+func (pm *ProxyManager) changeThroughput(prx *Proxy, newVal float64) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+
+	prx = pm.resolve(prx)
 	stats, exists := pm.proxies[prx]
 	if !exists {
-		//logging.Warn("changeHandshakeAvg: proxy not found")
 		return
 	}
-
-	var difference time.Duration
-	if newVal >= stats.handshakeAvg {
-		difference = newVal - stats.handshakeAvg
+	if stats.throughput == 0 {
+		stats.throughput = newVal
 	} else {
-		difference = stats.handshakeAvg - newVal
+		stats.throughput = pm.ewmaAlpha*newVal + (1-pm.ewmaAlpha)*stats.throughput
 	}
-	if difference >= constants.PRXMINHSAVGDIFF {
-		stats.handshakeAvg = (stats.handshakeAvg + newVal) / 2
-		pm.proxies[prx] = stats
-		pm.sortProxies()
+	pm.proxies[prx] = stats
+	pm.sortProxies()
+}
+
+// record a success and feed its handshake sample to the latency estimate
+func (pm *ProxyManager) addSuccess(prx *Proxy, sample time.Duration) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+
+	prx = pm.resolve(prx)
+	stats, exists := pm.proxies[prx]
+	if !exists {
+		return
 	}
+	stats.latency.add(sample, pm.ewmaAlpha)
+	pm.recordOutcome(prx, stats, 0)
+	pm.sortProxies()
 }
 
-// increment errors counter (del when limit is reached)
-func (pm *ProxyManager) addError(prx *Proxy, error string) {
-	if strings.HasPrefix(error, "crit") {
-		pm.cond.L.Lock()
-		defer pm.cond.L.Unlock()
+// record a failure weighted by the error's penalty (breaker may trip)
+func (pm *ProxyManager) addError(prx *Proxy, err error) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
 
-		stats, exists := pm.proxies[prx]
-		if !exists {
-			//logging.Warn("addError: proxy not found")
-			return
-		}
-		stats.errors++
-		stats.lastErr = error
+	prx = pm.resolve(prx)
+	stats, exists := pm.proxies[prx]
+	if !exists {
+		//logging.Warn("addError: proxy not found")
+		return
+	}
+	class := ClassOf(err)
+	stats.lastErr = class.String() + ": " + err.Error()
+	if pm.penalties[class] == 0 {
+		// not the proxy's fault
 		pm.proxies[prx] = stats
-		if stats.errors > constants.PRXMAXERRS {
-			delete(pm.proxies, prx)
-			pm.badProxies[prx] = stats
-			pm.rmFromSorted(prx)
-			logging.Warn("proxy " + prx.Address + " is removed due to exceeding the error limit (last err \"" + error + "\")")
-		}
+		return
 	}
+	pm.recordOutcome(prx, stats, pm.penalties[class])
 }
 
-// returns the best available proxy
-func (pm *ProxyManager) getBestProxy() *Proxy {
+// returns the best available proxy which isn't saturated, if there is none returns
+// a half-open one as a trial (trial is true then). nil if there is nothing to give.
+// the proxy counts towards its cap until it is released
+func (pm *ProxyManager) getBestProxy() (prx *Proxy, trial bool) {
 	pm.cond.L.Lock()
 	defer pm.cond.L.Unlock()
-	if len(pm.sortedProxies) == 0 {
-		// rotate maps
-		for k, v := range pm.badProxies {
-			pm.addProxyHS(k.Address, k.Proto, v.handshakeAvg)
+	for _, prx := range pm.sortedProxies {
+		stats := pm.proxies[prx]
+		if limit := pm.maxConnsOf(prx); limit == 0 || stats.inFlight < limit {
+			stats.inFlight++
+			pm.proxies[prx] = stats
+			return prx, false
 		}
-		pm.badProxies = make(map[*Proxy]proxyStats)
-		pm.cond.Broadcast()
 	}
-	return pm.sortedProxies[0]
+	prx = pm.halfOpenProxy()
+	switch {
+	case prx != nil:
+		metrics.PoolFallbacks.Inc("half_open")
+		stats := pm.badProxies[prx]
+		stats.inFlight++
+		pm.badProxies[prx] = stats
+	case len(pm.sortedProxies) != 0:
+		metrics.PoolFallbacks.Inc("saturated")
+	default:
+		metrics.PoolFallbacks.Inc("none")
+	}
+	return prx, prx != nil
+}
+
+// how many relays prx can serve at once, 0 means unlimited
+func (pm *ProxyManager) maxConnsOf(prx *Proxy) int {
+	if prx.MaxConns != 0 {
+		return prx.MaxConns
+	}
+	return pm.maxInFlight
+}
+
+// undoes inFlight increment of getBestProxy, for relay leases
+func (pm *ProxyManager) release(prx *Proxy) {
+	pm.cond.L.Lock()
+	defer pm.cond.L.Unlock()
+	if prx = pm.resolve(prx); prx == nil {
+		return
+	}
+	if stats, ok := pm.proxies[prx]; ok && stats.inFlight > 0 {
+		stats.inFlight--
+		pm.proxies[prx] = stats
+	} else if stats, ok := pm.badProxies[prx]; ok && stats.inFlight > 0 {
+		stats.inFlight--
+		pm.badProxies[prx] = stats
+	}
+}
+
+// returns the manager's *Proxy with prx's key, nil if there is none. leases hold on
+// to their proxies, which may have been removed and added again (as another *Proxy)
+// meanwhile. pm.cond.L must be held
+func (pm *ProxyManager) resolve(prx *Proxy) *Proxy {
+	return pm.byKey[prx.key()]
+}
+
+// ranking value, lower is better: latency estimate plus (if known and enabled) the
+// estimated time to download PRXBWREFSIZE bytes, divided by the proxy's weight
+func (pm *ProxyManager) score(prx *Proxy, stats proxyStats) time.Duration {
+	score := stats.latency.ewma
+	if pm.bwWeight != 0 && stats.throughput != 0 {
+		xfer := float64(constants.PRXBWREFSIZE) / stats.throughput * pm.bwWeight
+		score += time.Duration(xfer * float64(time.Second))
+	}
+	if prx.Weight != 0 {
+		score = time.Duration(float64(score) / prx.Weight)
+	}
+	return score
 }
 
 func (pm *ProxyManager) sortProxies() {
 	sort.Slice(pm.sortedProxies, func(i, j int) bool {
-		return pm.proxies[pm.sortedProxies[i]].handshakeAvg < pm.proxies[pm.sortedProxies[j]].handshakeAvg
+		pi, pj := pm.sortedProxies[i], pm.sortedProxies[j]
+		return pm.score(pi, pm.proxies[pi]) < pm.score(pj, pm.proxies[pj])
 	})
 }
 
@@ -0,0 +1,765 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodes a base64 subscription, newlines inside the block are allowed
+func decodeBase64(data []byte) ([]byte, bool) {
+	compact := bytes.Join(bytes.Fields(data), nil)
+	if len(compact) == 0 {
+		return nil, false
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := enc.DecodeString(string(compact)); err == nil {
+			return decoded, true
+		}
+	}
+	return nil, false
+}
+
+// a proxy from a subscription, in terms common to clash and sing-box
+type endpoint struct {
+	name     string
+	kind     string // http, socks5, socks4, ss, vmess, vless or trojan
+	server   string
+	port     int
+	user     string // username, uuid of vmess and vless
+	pass     string // password of http, socks, ss and trojan
+	method   string // ss cipher, vmess security
+	alterID  int
+	flow     string
+	tls      bool
+	reality  bool
+	insecure bool
+	sni      string
+	fp       string
+	alpn     []string
+	pbk      string // reality public key
+	sid      string // reality short id
+	network  string // tcp, ws, grpc, http (h2) or httpupgrade
+	path     string
+	host     string
+	service  string // grpc service name
+}
+
+var errUnsupported = errors.New("unsupported proxy type")
+
+// makes a share link out of an endpoint which needs xray
+func (e *endpoint) link() (string, error) {
+	hostport := net.JoinHostPort(e.server, strconv.Itoa(e.port))
+	u := url.URL{Host: hostport, Fragment: e.name}
+	switch e.kind {
+	case "ss":
+		u.Scheme = "ss"
+		u.User = url.User(base64.RawURLEncoding.EncodeToString([]byte(e.method + ":" + e.pass)))
+		return u.String(), nil
+	case "vmess":
+		return e.vmessLink(), nil
+	case "vless", "trojan":
+		u.Scheme = e.kind
+		q := url.Values{}
+		if e.kind == "vless" {
+			u.User = url.User(e.user)
+			q.Set("encryption", "none")
+		} else {
+			u.User = url.User(e.pass)
+		}
+		q.Set("security", e.security())
+		q.Set("type", e.transport())
+		setNonEmpty(q, "flow", e.flow)
+		setNonEmpty(q, "sni", e.sni)
+		setNonEmpty(q, "fp", e.fp)
+		setNonEmpty(q, "alpn", strings.Join(e.alpn, ","))
+		setNonEmpty(q, "pbk", e.pbk)
+		setNonEmpty(q, "sid", e.sid)
+		setNonEmpty(q, "path", e.path)
+		setNonEmpty(q, "host", e.host)
+		setNonEmpty(q, "serviceName", e.service)
+		if e.insecure {
+			q.Set("allowInsecure", "1")
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+	return "", errUnsupported
+}
+
+// vmess links carry a base64 encoded json instead of an url
+func (e *endpoint) vmessLink() string {
+	path := e.path
+	if e.transport() == "grpc" {
+		path = e.service
+	}
+	tls := ""
+	if e.tls {
+		tls = "tls"
+	}
+	conf, _ := json.Marshal(map[string]string{
+		"v":    "2",
+		"ps":   e.name,
+		"add":  e.server,
+		"port": strconv.Itoa(e.port),
+		"id":   e.user,
+		"aid":  strconv.Itoa(e.alterID),
+		"scy":  e.method,
+		"net":  e.transport(),
+		"type": "none",
+		"host": e.host,
+		"path": path,
+		"tls":  tls,
+		"sni":  e.sni,
+		"alpn": strings.Join(e.alpn, ","),
+		"fp":   e.fp,
+	})
+	return "vmess://" + base64.StdEncoding.EncodeToString(conf)
+}
+
+// makes an endpoint out of a share link, the reverse of link
+func linkEndpoint(link string) (*endpoint, error) {
+	if b64, ok := strings.CutPrefix(link, "vmess://"); ok {
+		return vmessEndpoint(b64)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	e := &endpoint{kind: u.Scheme, name: u.Fragment}
+	if e.kind == "ss" && u.Port() == "" {
+		// legacy links encode all of "method:pass@host:port"
+		decoded, ok := decodeBase64([]byte(u.Host))
+		if !ok {
+			return nil, errInvalidAddr
+		}
+		if u, err = url.Parse("ss://" + string(decoded)); err != nil {
+			return nil, err
+		}
+	}
+	e.server = u.Hostname()
+	if e.port, err = strconv.Atoi(u.Port()); err != nil {
+		return nil, errInvalidAddr
+	}
+	q := u.Query()
+	switch e.kind {
+	case "ss":
+		userinfo := u.User.Username()
+		if pass, ok := u.User.Password(); ok {
+			userinfo += ":" + pass
+		} else if decoded, ok := decodeBase64([]byte(userinfo)); ok {
+			userinfo = string(decoded)
+		}
+		var ok bool
+		if e.method, e.pass, ok = strings.Cut(userinfo, ":"); !ok {
+			return nil, errors.New("ss link without a cipher")
+		}
+		return e, nil
+	case "vless":
+		e.user = u.User.Username()
+	case "trojan":
+		e.pass = u.User.Username()
+	default:
+		return nil, errUnsupported
+	}
+	switch q.Get("security") {
+	case "tls":
+		e.tls = true
+	case "reality":
+		e.tls, e.reality = true, true
+	}
+	e.network = q.Get("type")
+	e.flow = q.Get("flow")
+	e.sni = q.Get("sni")
+	e.fp = q.Get("fp")
+	if alpn := q.Get("alpn"); alpn != "" {
+		e.alpn = strings.Split(alpn, ",")
+	}
+	e.pbk = q.Get("pbk")
+	e.sid = q.Get("sid")
+	e.path = q.Get("path")
+	e.host = q.Get("host")
+	e.service = q.Get("serviceName")
+	e.insecure = q.Get("allowInsecure") == "1"
+	return e, nil
+}
+
+func vmessEndpoint(b64 string) (*endpoint, error) {
+	decoded, ok := decodeBase64([]byte(b64))
+	if !ok {
+		return nil, errors.New("vmess link isn't base64")
+	}
+	var conf map[string]any
+	if err := json.Unmarshal(decoded, &conf); err != nil {
+		return nil, err
+	}
+	// numbers are strings in some links
+	str := func(key string) string {
+		switch v := conf[key].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return ""
+	}
+	e := &endpoint{
+		kind:    "vmess",
+		name:    str("ps"),
+		server:  str("add"),
+		user:    str("id"),
+		method:  str("scy"),
+		network: str("net"),
+		host:    str("host"),
+		path:    str("path"),
+		tls:     str("tls") == "tls",
+		sni:     str("sni"),
+		fp:      str("fp"),
+	}
+	var err error
+	if e.port, err = strconv.Atoi(str("port")); err != nil {
+		return nil, errInvalidAddr
+	}
+	e.alterID, _ = strconv.Atoi(str("aid"))
+	if alpn := str("alpn"); alpn != "" {
+		e.alpn = strings.Split(alpn, ",")
+	}
+	if e.network == "grpc" {
+		e.service, e.path = e.path, ""
+	}
+	return e, nil
+}
+
+// makes a clash proxy out of the endpoint, the reverse of parseClash
+func (e *endpoint) clash() (map[string]any, error) {
+	cp := map[string]any{
+		"name":   e.name,
+		"type":   e.kind,
+		"server": e.server,
+		"port":   e.port,
+	}
+	switch e.kind {
+	case "http", "socks5":
+		if e.user != "" {
+			cp["username"], cp["password"] = e.user, e.pass
+		}
+	case "ss":
+		cp["cipher"], cp["password"] = e.method, e.pass
+		return cp, nil
+	case "vmess":
+		cp["uuid"], cp["alterId"], cp["cipher"] = e.user, e.alterID, e.method
+	case "vless":
+		cp["uuid"] = e.user
+		setNonEmptyMap(cp, "flow", e.flow)
+	case "trojan":
+		cp["password"] = e.pass
+	default:
+		// socks4 and whatever else clash has no type for
+		return nil, errUnsupported
+	}
+	if e.tls && e.kind != "trojan" {
+		cp["tls"] = true
+	}
+	if e.insecure {
+		cp["skip-cert-verify"] = true
+	}
+	setNonEmptyMap(cp, "sni", e.sni)
+	setNonEmptyMap(cp, "client-fingerprint", e.fp)
+	if len(e.alpn) != 0 {
+		cp["alpn"] = e.alpn
+	}
+	if e.reality {
+		cp["reality-opts"] = map[string]string{"public-key": e.pbk, "short-id": e.sid}
+	}
+	switch e.transport() {
+	case "tcp":
+	case "ws":
+		cp["network"] = "ws"
+		opts := map[string]any{"path": e.path}
+		if e.host != "" {
+			opts["headers"] = map[string]string{"Host": e.host}
+		}
+		cp["ws-opts"] = opts
+	case "grpc":
+		cp["network"] = "grpc"
+		cp["grpc-opts"] = map[string]string{"grpc-service-name": e.service}
+	case "http":
+		cp["network"] = "h2"
+	default:
+		return nil, errUnsupported
+	}
+	return cp, nil
+}
+
+func setNonEmptyMap(m map[string]any, key string, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
+
+func (e *endpoint) security() string {
+	if e.reality {
+		return "reality"
+	}
+	if e.tls {
+		return "tls"
+	}
+	return "none"
+}
+
+func (e *endpoint) transport() string {
+	if e.network == "" {
+		return "tcp"
+	}
+	return e.network
+}
+
+func setNonEmpty(q url.Values, key string, value string) {
+	if value != "" {
+		q.Set(key, value)
+	}
+}
+
+// makes a proxy out of the endpoint: a plain one for http and socks, the one of its
+// share link for the rest. servers of plain proxies may be hostnames, subscriptions
+// give them as often as ips
+func (e *endpoint) proxy() (*Proxy, error) {
+	prot, plain := schemes[e.kind]
+	if !plain {
+		link, err := e.link()
+		if err != nil {
+			return nil, err
+		}
+		return shareLinkProxy(link)
+	}
+	if !isValidHost(e.server) || e.port < 1 || e.port > 65535 {
+		return nil, errInvalidAddr
+	}
+	if prot == HTTP && e.tls {
+		prot = HTTPS
+	}
+	return &Proxy{
+		Address: net.JoinHostPort(e.server, strconv.Itoa(e.port)),
+		Proto:   prot,
+		User:    e.user,
+		Pass:    e.pass,
+	}, nil
+}
+
+// tells if host is an ipv4 address or a hostname, proxies are dialed over ipv4
+func isValidHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4() != nil
+	}
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// adds proxies made out of endpoints to l
+func fromEndpoints(endpoints []endpoint, l *list) {
+	for _, e := range endpoints {
+		entry := e.kind + " " + e.name
+		prx, err := e.proxy()
+		if err != nil {
+			l.bad(0, entry, err)
+			continue
+		}
+		l.add(prx, 0, entry)
+	}
+}
+
+type clashProxy struct {
+	Name           string    `yaml:"name"`
+	Type           string    `yaml:"type"`
+	Server         string    `yaml:"server"`
+	Port           clashPort `yaml:"port"`
+	Username       string    `yaml:"username"`
+	Password       string    `yaml:"password"`
+	UUID           string    `yaml:"uuid"`
+	AlterID        int       `yaml:"alterId"`
+	Cipher         string    `yaml:"cipher"`
+	TLS            bool      `yaml:"tls"`
+	SNI            string    `yaml:"sni"`
+	ServerName     string    `yaml:"servername"`
+	SkipCertVerify bool      `yaml:"skip-cert-verify"`
+	Fingerprint    string    `yaml:"client-fingerprint"`
+	Flow           string    `yaml:"flow"`
+	Network        string    `yaml:"network"`
+	ALPN           []string  `yaml:"alpn"`
+	WSOpts         struct {
+		Path    string            `yaml:"path"`
+		Headers map[string]string `yaml:"headers"`
+	} `yaml:"ws-opts"`
+	GRPCOpts struct {
+		ServiceName string `yaml:"grpc-service-name"`
+	} `yaml:"grpc-opts"`
+	RealityOpts struct {
+		PublicKey string `yaml:"public-key"`
+		ShortID   string `yaml:"short-id"`
+	} `yaml:"reality-opts"`
+}
+
+// some configs quote ports
+type clashPort int
+
+func (p *clashPort) UnmarshalYAML(value *yaml.Node) error {
+	port, err := strconv.Atoi(value.Value)
+	if err != nil {
+		// lets the rest of the config be decoded
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: bad port %q", value.Line, value.Value)}}
+	}
+	*p = clashPort(port)
+	return nil
+}
+
+// reads the proxies list of a clash config
+func parseClash(data []byte, l *list) error {
+	var conf struct {
+		Proxies []clashProxy `yaml:"proxies"`
+	}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		var terr *yaml.TypeError
+		if !errors.As(err, &terr) {
+			return err
+		}
+		// whatever could be decoded is still usable
+		for _, msg := range terr.Errors {
+			l.bad(0, "", errors.New(msg))
+		}
+	}
+
+	endpoints := make([]endpoint, 0, len(conf.Proxies))
+	for _, cp := range conf.Proxies {
+		e := endpoint{
+			name:     cp.Name,
+			kind:     cp.Type,
+			server:   cp.Server,
+			port:     int(cp.Port),
+			user:     cp.Username,
+			pass:     cp.Password,
+			method:   cp.Cipher,
+			alterID:  cp.AlterID,
+			flow:     cp.Flow,
+			tls:      cp.TLS,
+			reality:  cp.RealityOpts.PublicKey != "",
+			insecure: cp.SkipCertVerify,
+			sni:      cp.SNI,
+			fp:       cp.Fingerprint,
+			alpn:     cp.ALPN,
+			pbk:      cp.RealityOpts.PublicKey,
+			sid:      cp.RealityOpts.ShortID,
+			network:  cp.Network,
+			path:     cp.WSOpts.Path,
+			host:     cp.WSOpts.Headers["Host"],
+			service:  cp.GRPCOpts.ServiceName,
+		}
+		if e.sni == "" {
+			e.sni = cp.ServerName
+		}
+		switch cp.Type {
+		case "socks5":
+		case "vmess", "vless":
+			e.user = cp.UUID
+			if cp.Type == "vmess" && e.method == "" {
+				e.method = "auto"
+			}
+		case "trojan":
+			// trojan is always over tls
+			e.tls = true
+		}
+		if e.network == "h2" {
+			e.network = "http"
+		}
+		endpoints = append(endpoints, e)
+	}
+	fromEndpoints(endpoints, l)
+	return nil
+}
+
+type singBoxOutbound struct {
+	Type       string `json:"type"`
+	Tag        string `json:"tag"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Version    string `json:"version"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	UUID       string `json:"uuid"`
+	Method     string `json:"method"`
+	Security   string `json:"security"`
+	AlterID    int    `json:"alter_id"`
+	Flow       string `json:"flow"`
+	TLS        struct {
+		Enabled    bool     `json:"enabled"`
+		ServerName string   `json:"server_name"`
+		Insecure   bool     `json:"insecure"`
+		ALPN       []string `json:"alpn"`
+		UTLS       struct {
+			Fingerprint string `json:"fingerprint"`
+		} `json:"utls"`
+		Reality struct {
+			Enabled   bool   `json:"enabled"`
+			PublicKey string `json:"public_key"`
+			ShortID   string `json:"short_id"`
+		} `json:"reality"`
+	} `json:"tls"`
+	Transport struct {
+		Type        string            `json:"type"`
+		Path        string            `json:"path"`
+		Host        json.RawMessage   `json:"host"` // string or list of strings
+		Headers     map[string]string `json:"headers"`
+		ServiceName string            `json:"service_name"`
+	} `json:"transport"`
+}
+
+// names of sing-box outbound types in endpoint terms, ones missing aren't proxies
+var singBoxKinds = map[string]string{
+	"http":        "http",
+	"socks":       "socks5",
+	"shadowsocks": "ss",
+	"vmess":       "vmess",
+	"vless":       "vless",
+	"trojan":      "trojan",
+}
+
+// reads the proxy outbounds of a sing-box config, skipping direct, block, selectors etc.
+func parseSingBox(data []byte, l *list) error {
+	var conf struct {
+		Outbounds []singBoxOutbound `json:"outbounds"`
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return err
+	}
+
+	endpoints := make([]endpoint, 0, len(conf.Outbounds))
+	for _, ob := range conf.Outbounds {
+		kind, ok := singBoxKinds[ob.Type]
+		if !ok {
+			if ob.Server != "" {
+				l.bad(0, ob.Type+" "+ob.Tag, errUnsupported)
+			}
+			continue
+		}
+		if kind == "socks5" && strings.HasPrefix(ob.Version, "4") {
+			kind = "socks4"
+		}
+		e := endpoint{
+			name:     ob.Tag,
+			kind:     kind,
+			server:   ob.Server,
+			port:     ob.ServerPort,
+			user:     ob.Username,
+			pass:     ob.Password,
+			method:   ob.Method,
+			alterID:  ob.AlterID,
+			flow:     ob.Flow,
+			tls:      ob.TLS.Enabled,
+			reality:  ob.TLS.Reality.Enabled,
+			insecure: ob.TLS.Insecure,
+			sni:      ob.TLS.ServerName,
+			fp:       ob.TLS.UTLS.Fingerprint,
+			alpn:     ob.TLS.ALPN,
+			pbk:      ob.TLS.Reality.PublicKey,
+			sid:      ob.TLS.Reality.ShortID,
+			network:  ob.Transport.Type,
+			path:     ob.Transport.Path,
+			host:     ob.Transport.Headers["Host"],
+			service:  ob.Transport.ServiceName,
+		}
+		if kind == "vmess" || kind == "vless" {
+			e.user = ob.UUID
+		}
+		if kind == "vmess" {
+			e.method = ob.Security
+			if e.method == "" {
+				e.method = "auto"
+			}
+		}
+		if e.host == "" && len(ob.Transport.Host) > 0 {
+			var hosts []string
+			if json.Unmarshal(ob.Transport.Host, &e.host) != nil && json.Unmarshal(ob.Transport.Host, &hosts) == nil && len(hosts) > 0 {
+				e.host = hosts[0]
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+	fromEndpoints(endpoints, l)
+	return nil
+}
+
+type xrayOutbound struct {
+	Protocol string `json:"protocol"`
+	Tag      string `json:"tag"`
+	Settings struct {
+		Servers []xrayServer `json:"servers"` // http, socks, shadowsocks and trojan
+		Vnext   []xrayServer `json:"vnext"`   // vmess and vless
+	} `json:"settings"`
+	StreamSettings struct {
+		Network     string `json:"network"`
+		Security    string `json:"security"`
+		TLSSettings struct {
+			ServerName    string   `json:"serverName"`
+			AllowInsecure bool     `json:"allowInsecure"`
+			ALPN          []string `json:"alpn"`
+			Fingerprint   string   `json:"fingerprint"`
+		} `json:"tlsSettings"`
+		RealitySettings struct {
+			ServerName  string `json:"serverName"`
+			Fingerprint string `json:"fingerprint"`
+			PublicKey   string `json:"publicKey"`
+			ShortID     string `json:"shortId"`
+		} `json:"realitySettings"`
+		WSSettings struct {
+			Path    string            `json:"path"`
+			Host    string            `json:"host"`
+			Headers map[string]string `json:"headers"`
+		} `json:"wsSettings"`
+		GRPCSettings struct {
+			ServiceName string `json:"serviceName"`
+		} `json:"grpcSettings"`
+		HTTPSettings struct {
+			Path string   `json:"path"`
+			Host []string `json:"host"`
+		} `json:"httpSettings"`
+		HTTPUpgradeSettings struct {
+			Path string `json:"path"`
+			Host string `json:"host"`
+		} `json:"httpupgradeSettings"`
+	} `json:"streamSettings"`
+}
+
+type xrayServer struct {
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Method   string `json:"method"`
+	Password string `json:"password"`
+	Users    []struct {
+		User     string `json:"user"`
+		Pass     string `json:"pass"`
+		ID       string `json:"id"`
+		AlterID  int    `json:"alterId"`
+		Security string `json:"security"`
+		Flow     string `json:"flow"`
+	} `json:"users"`
+}
+
+// names of xray outbound protocols in endpoint terms, ones missing aren't proxies
+var xrayKinds = map[string]string{
+	"http":        "http",
+	"socks":       "socks5",
+	"shadowsocks": "ss",
+	"vmess":       "vmess",
+	"vless":       "vless",
+	"trojan":      "trojan",
+}
+
+// reads the proxy outbounds of an xray config (the first server of each), skipping
+// freedom, blackhole etc.
+func parseXray(data []byte, l *list) error {
+	var conf struct {
+		Outbounds []xrayOutbound `json:"outbounds"`
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return err
+	}
+
+	endpoints := make([]endpoint, 0, len(conf.Outbounds))
+	for _, ob := range conf.Outbounds {
+		servers := ob.Settings.Servers
+		if len(servers) == 0 {
+			servers = ob.Settings.Vnext
+		}
+		kind, ok := xrayKinds[ob.Protocol]
+		if !ok || len(servers) == 0 {
+			if len(servers) != 0 {
+				l.bad(0, ob.Protocol+" "+ob.Tag, errUnsupported)
+			}
+			continue
+		}
+		srv := servers[0]
+		st := ob.StreamSettings
+		e := endpoint{
+			name:     ob.Tag,
+			kind:     kind,
+			server:   srv.Address,
+			port:     srv.Port,
+			pass:     srv.Password,
+			method:   srv.Method,
+			tls:      st.Security == "tls" || st.Security == "reality",
+			reality:  st.Security == "reality",
+			insecure: st.TLSSettings.AllowInsecure,
+			sni:      st.TLSSettings.ServerName,
+			fp:       st.TLSSettings.Fingerprint,
+			alpn:     st.TLSSettings.ALPN,
+			pbk:      st.RealitySettings.PublicKey,
+			sid:      st.RealitySettings.ShortID,
+			network:  st.Network,
+		}
+		if e.reality {
+			e.sni, e.fp = st.RealitySettings.ServerName, st.RealitySettings.Fingerprint
+		}
+		if len(srv.Users) != 0 {
+			u := srv.Users[0]
+			e.user, e.flow, e.alterID, e.method = u.ID, u.Flow, u.AlterID, u.Security
+			if kind == "http" || kind == "socks5" {
+				e.user, e.pass = u.User, u.Pass
+			}
+		}
+		if kind == "vmess" && e.method == "" {
+			e.method = "auto"
+		}
+		switch e.network {
+		case "raw":
+			e.network = "tcp"
+		case "ws":
+			e.path, e.host = st.WSSettings.Path, st.WSSettings.Host
+			if e.host == "" {
+				e.host = st.WSSettings.Headers["Host"]
+			}
+		case "grpc":
+			e.service = st.GRPCSettings.ServiceName
+		case "h2", "http":
+			e.network, e.path = "http", st.HTTPSettings.Path
+			if len(st.HTTPSettings.Host) != 0 {
+				e.host = st.HTTPSettings.Host[0]
+			}
+		case "httpupgrade":
+			e.path, e.host = st.HTTPUpgradeSettings.Path, st.HTTPUpgradeSettings.Host
+		}
+		endpoints = append(endpoints, e)
+	}
+	fromEndpoints(endpoints, l)
+	return nil
+}
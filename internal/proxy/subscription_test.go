@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSubscriptionHostnames(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		addr   string
+		proto  Protocol
+		user   string
+	}{
+		{
+			name:   "clash http hostname",
+			format: FormatClash,
+			data:   "proxies:\n  - {name: a, type: http, server: example.com, port: 80}\n",
+			addr:   "example.com:80",
+			proto:  HTTP,
+		},
+		{
+			name:   "clash http tls hostname with credentials",
+			format: FormatClash,
+			data:   "proxies:\n  - {name: a, type: http, server: proxy.example.com, port: \"8443\", tls: true, username: u, password: p}\n",
+			addr:   "proxy.example.com:8443",
+			proto:  HTTPS,
+			user:   "u",
+		},
+		{
+			name:   "clash socks5 ip",
+			format: FormatClash,
+			data:   "proxies:\n  - {name: a, type: socks5, server: 203.0.113.7, port: 1080}\n",
+			addr:   "203.0.113.7:1080",
+			proto:  SOCKS5,
+		},
+		{
+			name:   "sing-box socks hostname",
+			format: FormatSingBox,
+			data:   `{"outbounds": [{"type": "socks", "tag": "a", "server": "socks.example.org", "server_port": 1080}, {"type": "direct", "tag": "direct"}]}`,
+			addr:   "socks.example.org:1080",
+			proto:  SOCKS5,
+		},
+		{
+			name:   "sing-box socks4 hostname",
+			format: FormatSingBox,
+			data:   `{"outbounds": [{"type": "socks", "version": "4a", "tag": "a", "server": "s4.example.org", "server_port": 1080}]}`,
+			addr:   "s4.example.org:1080",
+			proto:  SOCKS4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxies, err := Parse([]byte(tt.data), ParseOptions{Format: tt.format, Name: "test", Strict: true})
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if len(proxies) != 1 {
+				t.Fatalf("got %d proxies, want 1", len(proxies))
+			}
+			prx := proxies[0]
+			if prx.Address != tt.addr || prx.Proto != tt.proto || prx.User != tt.user {
+				t.Errorf("got %s://%s user %q, want %s://%s user %q", prx.Proto, prx.Address, prx.User, tt.proto, tt.addr, tt.user)
+			}
+		})
+	}
+}
+
+func TestSubscriptionBadServers(t *testing.T) {
+	for _, server := range []string{"bad_host!", "-example.com", "a..b", "2001:db8::1", ""} {
+		data := "proxies:\n  - {name: a, type: http, server: \"" + server + "\", port: 80}\n"
+		_, err := Parse([]byte(data), ParseOptions{Format: FormatClash, Name: "test", Strict: true})
+		var lerr ListError
+		if !errors.As(err, &lerr) || len(lerr) != 1 || !errors.Is(lerr[0].Err, errInvalidAddr) {
+			t.Errorf("server %q: got %v, want an invalid addr diagnostic", server, err)
+		}
+	}
+}
+
+func TestSubscriptionBadPort(t *testing.T) {
+	data := `{"outbounds": [{"type": "http", "tag": "a", "server": "example.com", "server_port": 0}]}`
+	proxies, err := Parse([]byte(data), ParseOptions{Format: FormatSingBox, Name: "test"})
+	if err != nil || len(proxies) != 0 {
+		t.Errorf("got %d proxies and %v, want the entry skipped", len(proxies), err)
+	}
+}
+
+// proxies imported from subscriptions survive being written in any format and read back
+func TestSubscriptionRoundTrip(t *testing.T) {
+	inputs := []struct {
+		format string
+		data   string
+	}{
+		{FormatClash, "proxies:\n" +
+			"  - {name: a, type: socks5, server: socks.example.com, port: 1080, username: u, password: p}\n" +
+			"  - {name: b, type: socks5, server: 203.0.113.7, port: 1081}\n"},
+		{FormatSingBox, `{"outbounds": [` +
+			`{"type": "socks", "tag": "a", "server": "socks.example.com", "server_port": 1080, "username": "u", "password": "p"},` +
+			`{"type": "socks", "tag": "b", "server": "203.0.113.7", "server_port": 1081}]}`},
+	}
+	outputs := []struct {
+		format string // written
+		parse  ParseOptions
+	}{
+		{FormatLines, ParseOptions{Format: FormatLines}},
+		{FormatBase64, ParseOptions{Format: FormatBase64}},
+		{FormatPool, ParseOptions{Format: FormatPool}},
+		{FormatJSON, ParseOptions{Format: FormatPool}},
+		{FormatClash, ParseOptions{Format: FormatClash}},
+		{FormatXray, ParseOptions{Format: FormatXray}},
+		{FormatVendor, ParseOptions{Format: FormatLines, Proto: "socks5"}},
+	}
+	for _, in := range inputs {
+		proxies, err := Parse([]byte(in.data), ParseOptions{Format: in.format, Name: "test", Strict: true})
+		if err != nil {
+			t.Fatalf("%s: Parse: %v", in.format, err)
+		}
+		for _, out := range outputs {
+			t.Run(in.format+" to "+out.format, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := Write(out.format, &buf, proxies); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+				opts := out.parse
+				opts.Name, opts.Strict = "written", true
+				back, err := Parse(buf.Bytes(), opts)
+				if err != nil {
+					t.Fatalf("Parse of %q: %v", buf.String(), err)
+				}
+				if len(back) != len(proxies) {
+					t.Fatalf("got %d proxies back, want %d", len(back), len(proxies))
+				}
+				for i, prx := range back {
+					if prx.key() != proxies[i].key() {
+						t.Errorf("got %s back, want %s", URL(prx), URL(proxies[i]))
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestXrayInput(t *testing.T) {
+	data := `{"outbounds": [
+		{"protocol": "freedom", "tag": "direct"},
+		{"protocol": "http", "tag": "a", "settings": {"servers": [{"address": "proxy.example.com", "port": 8443,
+			"users": [{"user": "u", "pass": "p"}]}]}, "streamSettings": {"security": "tls"}},
+		{"protocol": "socks", "tag": "b", "settings": {"servers": [{"address": "203.0.113.7", "port": 1080}]}}
+	]}`
+	if format := detectFormat([]byte(data)); format != FormatXray {
+		t.Fatalf("detected %s, want %s", format, FormatXray)
+	}
+	proxies, err := Parse([]byte(data), ParseOptions{Name: "test", Strict: true})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := []string{"https://u:p@proxy.example.com:8443", "socks5://203.0.113.7:1080"}
+	if len(proxies) != len(want) {
+		t.Fatalf("got %d proxies, want %d", len(proxies), len(want))
+	}
+	for i, prx := range proxies {
+		if URL(prx) != want[i] {
+			t.Errorf("got %s, want %s", URL(prx), want[i])
+		}
+	}
+}
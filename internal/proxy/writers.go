@@ -0,0 +1,324 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// formats proxy lists can be written in, besides the ones they are read in (but sing-box)
+const (
+	FormatJSON   = "json"   // pool file in json
+	FormatVendor = "vendor" // ip:port or ip:port:user:pass per line, protocols are lost
+)
+
+// IsOutputFormat tells if proxy lists can be written in format
+func IsOutputFormat(format string) bool {
+	switch format {
+	case FormatLines, FormatBase64, FormatPool, FormatJSON, FormatClash, FormatXray, FormatVendor:
+		return true
+	}
+	return false
+}
+
+// SkippedError is returned by writers when the format couldn't express some of the
+// proxies. the rest were written
+type SkippedError struct {
+	Format  string
+	Skipped int
+}
+
+func (e *SkippedError) Error() string {
+	return fmt.Sprintf("%s can't express %d of the proxies, they were skipped", e.Format, e.Skipped)
+}
+
+// Write writes proxies to w in format. proxies the format can't express are
+// skipped with a warning each and a SkippedError
+func Write(format string, w io.Writer, proxies []*Proxy) error {
+	return write(format, w, proxies, nil)
+}
+
+// Export writes every proxy of the manager in format, pool files (yaml and json)
+// get proxies' statistics too. skipped proxies are reported as in Write
+func (pm *ProxyManager) Export(format string, w io.Writer) error {
+	pm.cond.L.Lock()
+	n := len(pm.proxies) + len(pm.badProxies)
+	proxies := make([]*Proxy, 0, n)
+	infos := make([]ProxyInfo, 0, n)
+	for _, prx := range pm.sortedProxies {
+		proxies = append(proxies, prx)
+		infos = append(infos, newProxyInfo(prx, pm.proxies[prx], false))
+	}
+	for prx, stats := range pm.badProxies {
+		proxies = append(proxies, prx)
+		infos = append(infos, newProxyInfo(prx, stats, true))
+	}
+	pm.cond.L.Unlock()
+	return write(format, w, proxies, infos)
+}
+
+// infos are written by pool formats if not nil, they go in the same order as proxies
+func write(format string, w io.Writer, proxies []*Proxy, infos []ProxyInfo) error {
+	var skipped int
+	var err error
+	switch format {
+	case FormatLines:
+		err = writeLines(w, proxies)
+	case FormatBase64:
+		var buf bytes.Buffer
+		if err = writeLines(&buf, proxies); err == nil {
+			_, err = io.WriteString(w, base64.StdEncoding.EncodeToString(buf.Bytes())+"\n")
+		}
+	case FormatPool:
+		err = yaml.NewEncoder(w).Encode(poolOutput(proxies, infos))
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(poolOutput(proxies, infos))
+	case FormatClash:
+		skipped, err = writeClash(w, proxies)
+	case FormatXray:
+		skipped, err = writeXray(w, proxies)
+	case FormatVendor:
+		skipped, err = writeVendor(w, proxies)
+	default:
+		return errors.New("unknown output format " + format)
+	}
+	if err == nil && skipped != 0 {
+		err = &SkippedError{Format: format, Skipped: skipped}
+	}
+	return err
+}
+
+func writeLines(w io.Writer, proxies []*Proxy) error {
+	for _, prx := range proxies {
+		if _, err := fmt.Fprintln(w, Line(prx)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func skip(format string, prx *Proxy, err error) {
+	logging.Warn("format can't express the proxy, skipped", "format", format, "proxy", URL(prx), "error", err)
+}
+
+type poolOut struct {
+	Pool []poolEntryOut `yaml:"pool" json:"pool"`
+}
+
+// a pool file entry as written, stats are ignored when the file is read back
+type poolEntryOut struct {
+	URL      string          `yaml:"url" json:"url"`
+	Weight   float64         `yaml:"weight,omitempty" json:"weight,omitempty"`
+	Tags     []string        `yaml:"tags,omitempty" json:"tags,omitempty"`
+	MaxConns int             `yaml:"maxconns,omitempty" json:"maxconns,omitempty"`
+	Check    *checkOut       `yaml:"check,omitempty" json:"check,omitempty"`
+	Stats    *poolEntryStats `yaml:"stats,omitempty" json:"stats,omitempty"`
+}
+
+type checkOut struct {
+	URL      string `yaml:"url,omitempty" json:"url,omitempty"`
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+}
+
+type poolEntryStats struct {
+	Bad        bool    `yaml:"bad" json:"bad"`
+	State      string  `yaml:"state" json:"state"`
+	FailRate   float64 `yaml:"failrate" json:"failrate"`
+	LatencyMS  float64 `yaml:"latency_ms" json:"latency_ms"`
+	P50MS      float64 `yaml:"p50_ms" json:"p50_ms"`
+	P95MS      float64 `yaml:"p95_ms" json:"p95_ms"`
+	P99MS      float64 `yaml:"p99_ms" json:"p99_ms"`
+	Samples    uint64  `yaml:"samples" json:"samples"`
+	Throughput float64 `yaml:"throughput,omitempty" json:"throughput,omitempty"`
+	InFlight   int     `yaml:"inflight" json:"inflight"`
+	ExitIP     string  `yaml:"exit_ip,omitempty" json:"exit_ip,omitempty"`
+	LastCheck  string  `yaml:"last_check,omitempty" json:"last_check,omitempty"`
+	LastErr    string  `yaml:"last_error,omitempty" json:"last_error,omitempty"`
+}
+
+func poolOutput(proxies []*Proxy, infos []ProxyInfo) poolOut {
+	out := poolOut{Pool: make([]poolEntryOut, len(proxies))}
+	for i, prx := range proxies {
+		e := poolEntryOut{URL: URL(prx), Weight: prx.Weight, Tags: prx.Tags, MaxConns: prx.MaxConns}
+		if prx.Check != nil {
+			e.Check = &checkOut{URL: prx.Check.URL}
+			if prx.Check.Interval != 0 {
+				e.Check.Interval = prx.Check.Interval.String()
+			}
+		}
+		if infos != nil {
+			info := infos[i]
+			e.Stats = &poolEntryStats{
+				Bad:        info.Bad,
+				State:      info.State,
+				FailRate:   info.FailRate,
+				LatencyMS:  info.Latency.Seconds() * 1000,
+				P50MS:      info.P50.Seconds() * 1000,
+				P95MS:      info.P95.Seconds() * 1000,
+				P99MS:      info.P99.Seconds() * 1000,
+				Samples:    info.Samples,
+				Throughput: info.Throughput,
+				InFlight:   info.InFlight,
+				ExitIP:     info.ExitIP,
+				LastErr:    info.LastErr,
+			}
+			if !info.LastCheck.IsZero() {
+				e.Stats.LastCheck = info.LastCheck.UTC().Format(time.RFC3339)
+			}
+		}
+		out.Pool[i] = e
+	}
+	return out
+}
+
+func writeClash(w io.Writer, proxies []*Proxy) (int, error) {
+	var out struct {
+		Proxies []map[string]any `yaml:"proxies"`
+	}
+	names := make(map[string]int)
+	skipped := 0
+	for _, prx := range proxies {
+		e, err := proxyEndpoint(prx)
+		var cp map[string]any
+		if err == nil {
+			cp, err = e.clash()
+		}
+		if err != nil {
+			skip(FormatClash, prx, err)
+			skipped++
+			continue
+		}
+		// clash wants unique names, sessions of a gateway share the address
+		name := e.name
+		if name == "" {
+			name = fmt.Sprintf("%s-%s-%d", e.kind, e.server, e.port)
+		}
+		if names[name]++; names[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, names[name])
+		}
+		cp["name"] = name
+		out.Proxies = append(out.Proxies, cp)
+	}
+	return skipped, yaml.NewEncoder(w).Encode(out)
+}
+
+// endpoint of a proxy: made of the address of a plain one, of the share link of
+// an xray one
+func proxyEndpoint(prx *Proxy) (*endpoint, error) {
+	if link := shareLink(prx); link != "" {
+		return linkEndpoint(link)
+	}
+	host, port, ok := splitAddress(prx)
+	if !ok {
+		return nil, errInvalidAddr
+	}
+	e := &endpoint{kind: "http", server: host, port: port, user: prx.User, pass: prx.Pass}
+	switch prx.Proto {
+	case HTTPS:
+		e.tls = true
+	case SOCKS4:
+		e.kind = "socks4"
+	case SOCKS5:
+		e.kind = "socks5"
+	}
+	return e, nil
+}
+
+func writeXray(w io.Writer, proxies []*Proxy) (int, error) {
+	var outbounds []json.RawMessage
+	skipped := 0
+	for i, prx := range proxies {
+		tag := fmt.Sprintf("proxy_%d", i)
+		if ob := outbound(prx); ob != "" {
+			var conf map[string]any
+			if err := json.Unmarshal([]byte(ob), &conf); err != nil {
+				return skipped, err
+			}
+			conf["tag"] = tag
+			raw, _ := json.Marshal(conf)
+			outbounds = append(outbounds, raw)
+			continue
+		}
+		host, port, ok := splitAddress(prx)
+		if !ok || prx.Proto == SOCKS4 {
+			skip(FormatXray, prx, errUnsupported)
+			skipped++
+			continue
+		}
+		server := map[string]any{"address": host, "port": port}
+		if prx.User != "" {
+			server["users"] = []map[string]string{{"user": prx.User, "pass": prx.Pass}}
+		}
+		conf := map[string]any{
+			"tag":      tag,
+			"protocol": "socks",
+			"settings": map[string]any{"servers": []any{server}},
+		}
+		switch prx.Proto {
+		case HTTP:
+			conf["protocol"] = "http"
+		case HTTPS:
+			conf["protocol"] = "http"
+			conf["streamSettings"] = map[string]any{"security": "tls", "tlsSettings": map[string]any{"serverName": host}}
+		}
+		raw, _ := json.Marshal(conf)
+		outbounds = append(outbounds, raw)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return skipped, enc.Encode(map[string]any{"outbounds": outbounds})
+}
+
+func writeVendor(w io.Writer, proxies []*Proxy) (int, error) {
+	skipped := 0
+	for _, prx := range proxies {
+		if _, _, ok := splitAddress(prx); !ok {
+			skip(FormatVendor, prx, errUnsupported)
+			skipped++
+			continue
+		}
+		line := prx.Address
+		if prx.User != "" {
+			line += ":" + prx.User + ":" + prx.Pass
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+// host and port of a plain proxy, false for xray ones
+func splitAddress(prx *Proxy) (string, int, bool) {
+	if shareLink(prx) != "" || outbound(prx) != "" {
+		return "", 0, false
+	}
+	host, portStr, err := net.SplitHostPort(prx.Address)
+	if err != nil {
+		return "", 0, false
+	}
+	port, err := strconv.Atoi(portStr)
+	return host, port, err == nil
+}
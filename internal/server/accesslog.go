@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/logging"
+)
+
+// session collects what is written to the access log about one client connection
+type session struct {
+	client   string
+	user     string
+	target   string
+	proxy    string
+	protocol string
+	hs       time.Duration
+	start    time.Time
+	up       int64 // bytes from client
+	down     int64 // bytes to client
+	reason   string
+}
+
+// AccessLog writes a line per client connection which got as far as asking for a target
+type AccessLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+// NewAccessLog opens filename ("-" is stdout) for writing in format "json" or "clf".
+// maxSize and maxBackups control rotation as in logging.NewRotatingWriter
+func NewAccessLog(filename, format string, maxSize int64, maxBackups int) (*AccessLog, error) {
+	al := &AccessLog{}
+	switch format {
+	case "json":
+		al.json = true
+	case "clf":
+	default:
+		return nil, errors.New("unknown access log format " + format)
+	}
+	if filename == "-" {
+		al.w = os.Stdout
+		return al, nil
+	}
+	w, err := logging.NewRotatingWriter(filename, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	al.w = w
+	return al, nil
+}
+
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Target    string    `json:"target"`
+	Proxy     string    `json:"proxy,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Handshake float64   `json:"handshake_ms"`
+	Duration  float64   `json:"duration_ms"`
+	Up        int64     `json:"bytes_up"`
+	Down      int64     `json:"bytes_down"`
+	Reason    string    `json:"reason"`
+}
+
+func (al *AccessLog) write(s *session) {
+	if al == nil {
+		return
+	}
+	dur := time.Since(s.start)
+	var line []byte
+	if al.json {
+		line, _ = json.Marshal(accessEntry{
+			Time:      s.start,
+			Client:    s.client,
+			User:      s.user,
+			Target:    s.target,
+			Proxy:     s.proxy,
+			Protocol:  s.protocol,
+			Handshake: float64(s.hs.Microseconds()) / 1000,
+			Duration:  float64(dur.Microseconds()) / 1000,
+			Up:        s.up,
+			Down:      s.down,
+			Reason:    s.reason,
+		})
+		line = append(line, '\n')
+	} else {
+		// common log format with extra fields after it
+		line = fmt.Appendf(nil, "%s - %s [%s] \"CONNECT %s\" %s %d %d proxy=%s hs=%v dur=%v\n",
+			s.client, dash(s.user), s.start.Format("02/Jan/2006:15:04:05 -0700"), s.target,
+			s.reason, s.up, s.down, dash(s.protocol+"://"+s.proxy), s.hs.Round(time.Millisecond), dur.Round(time.Millisecond))
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := al.w.Write(line); err != nil {
+		logging.Error("unable to write access log", "error", err)
+	}
+}
+
+func dash(s string) string {
+	if s == "" || s == "://" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/logging"
+)
+
+// ACL tells which clients may use the listener and which destinations they may ask for.
+// rules are checked in order and the first matching one decides, nothing matched means allowed.
+// a nil *ACL allows everything
+type ACL struct {
+	file    string
+	modTime time.Time
+	rules   atomic.Pointer[aclRules]
+}
+
+type aclRule struct {
+	allow bool
+	nets  []*net.IPNet
+}
+
+type aclRules struct {
+	client []aclRule
+	dest   []aclRule
+}
+
+// what "private" stands for in rules: addresses which must not be reachable through the relay from outside
+var privateNets = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4",
+	"240.0.0.0/4", "255.255.255.255/32", "fc00::/7", "fe80::/10", "ff00::/8", "::1/128",
+}
+
+// LoadACL reads an acl file: one "allow|deny client|dest <cidr|ip|private|any>" per line,
+// "#" starts a comment
+func LoadACL(filename string) (*ACL, error) {
+	acl := &ACL{file: filename}
+	if err := acl.load(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func (a *ACL) load() error {
+	info, err := os.Stat(a.file)
+	if err != nil {
+		return err
+	}
+	rules, err := parseACL(a.file)
+	if err != nil {
+		return err
+	}
+	a.modTime = info.ModTime()
+	a.rules.Store(rules)
+	return nil
+}
+
+func parseACL(filename string) (*aclRules, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := &aclRules{}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"allow|deny client|dest address\"", filename, lineNumber)
+		}
+		var rule aclRule
+		switch fields[0] {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %s", filename, lineNumber, fields[0])
+		}
+		rule.nets, err = parseACLNets(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNumber, err)
+		}
+		switch fields[1] {
+		case "client":
+			rules.client = append(rules.client, rule)
+		case "dest":
+			rules.dest = append(rules.dest, rule)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown subject %s", filename, lineNumber, fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseACLNets(s string) ([]*net.IPNet, error) {
+	var cidrs []string
+	switch s {
+	case "any":
+		cidrs = []string{"0.0.0.0/0", "::/0"}
+	case "private":
+		cidrs = privateNets
+	default:
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %s", s)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			return []*net.IPNet{{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+		}
+		cidrs = []string{s}
+	}
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func match(rules []aclRule, ip net.IP) bool {
+	for _, r := range rules {
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				return r.allow
+			}
+		}
+	}
+	return true
+}
+
+// tells if a client from ip may use the listener
+func (a *ACL) allowClient(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	return match(a.rules.Load().client, ip)
+}
+
+// tells if clients may connect to ip through the relay
+func (a *ACL) allowDest(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	return match(a.rules.Load().dest, ip)
+}
+
+// ServeReload checks the acl file for changes every so often and reloads it
+// until ctx is done. if the new file is broken, the old rules stay
+func (a *ACL) ServeReload(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		info, err := os.Stat(a.file)
+		if err != nil {
+			logging.Error("unable to check acl file", "file", a.file, "error", err)
+			continue
+		}
+		if info.ModTime().Equal(a.modTime) {
+			continue
+		}
+		if err := a.load(); err != nil {
+			logging.Error("unable to reload acl, keeping the old rules", "file", a.file, "error", err)
+			a.modTime = info.ModTime() // don't complain again until it changes
+			continue
+		}
+		logging.Info("acl reloaded", "file", a.file)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeACL(t *testing.T, text string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(name, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestParseACL(t *testing.T) {
+	file := `# clients from the lan only
+allow client 10.0.0.0/8
+allow client 192.0.2.7 # a single address
+deny client any
+
+deny dest private
+allow dest 198.51.100.0/24
+deny dest any
+`
+	acl, err := LoadACL(writeACL(t, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip     string
+		client bool
+		dest   bool
+	}{
+		{"10.1.2.3", true, false},
+		{"192.0.2.7", true, false},
+		{"192.0.2.8", false, false},
+		{"198.51.100.9", false, true},
+		{"203.0.113.1", false, false},
+		{"127.0.0.1", false, false},
+		{"::1", false, false},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if got := acl.allowClient(ip); got != tt.client {
+			t.Errorf("allowClient(%s) = %v, want %v", tt.ip, got, tt.client)
+		}
+		if got := acl.allowDest(ip); got != tt.dest {
+			t.Errorf("allowDest(%s) = %v, want %v", tt.ip, got, tt.dest)
+		}
+	}
+}
+
+func TestParseACLErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{"allow client", "expected"},
+		{"permit client any", "unknown action"},
+		{"allow server any", "unknown subject"},
+		{"deny dest 300.1.1.1", "bad address"},
+		{"deny dest 10.0.0.0/33", "invalid CIDR"},
+	}
+	for _, tt := range tests {
+		_, err := LoadACL(writeACL(t, "allow client any\n"+tt.line+"\n"))
+		if err == nil || !strings.Contains(err.Error(), tt.err) || !strings.Contains(err.Error(), ":2:") {
+			t.Errorf("%q: error %v, want %q at line 2", tt.line, err, tt.err)
+		}
+	}
+}
+
+// nothing matched and a nil acl allow everything
+func TestACLDefaults(t *testing.T) {
+	acl, err := LoadACL(writeACL(t, "deny client 10.0.0.0/8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	if !acl.allowClient(ip) || !acl.allowDest(ip) {
+		t.Error("an unmatched address is denied")
+	}
+	var none *ACL
+	if !none.allowClient(ip) || !none.allowDest(ip) {
+		t.Error("a nil acl denies")
+	}
+}
+
+// a client denied by the acl gets a "not allowed" reply to its request
+func TestACLDeniedClient(t *testing.T) {
+	acl, err := LoadACL(writeACL(t, "deny client 127.0.0.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSrv(&Config{ACL: acl})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.handleConn(conn)
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if status := socksRequest(t, client); status != NOTALLOWED {
+		t.Errorf("status %#x, want NOTALLOWED", status)
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/limiter"
+	"github.com/etidart/proxyflow/internal/logging"
+)
+
+// User is a client allowed to use the listener
+type User struct {
+	Name  string
+	Pass  string
+	Up    *limiter.Bucket // bandwidth from the user, nil is unlimited
+	Down  *limiter.Bucket // bandwidth to the user, nil is unlimited
+	Quota int64           // bytes (both directions) per quota period, 0 is unlimited
+
+	used atomic.Int64 // bytes moved in the current quota period
+}
+
+// tells if the user has used up the quota of the current period
+func (u *User) overQuota() bool {
+	return u.Quota > 0 && u.used.Load() >= u.Quota
+}
+
+// LoadUsers reads a users file: one "name:password [option=value...]" per line,
+// "#" starts a comment. options are bw (both directions), bwup, bwdown in bytes
+// per second and quota in bytes per quota period. sizes may have a K, M, G or T suffix
+func LoadUsers(filename string) (map[string]*User, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		name, pass, ok := strings.Cut(fields[0], ":")
+		if !ok || name == "" || len(name) > 255 || len(pass) > 255 {
+			return nil, fmt.Errorf("%s:%d: expected name:password", filename, lineNumber)
+		}
+		if _, dup := users[name]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate user %s", filename, lineNumber, name)
+		}
+		user := &User{Name: name, Pass: pass}
+		for _, opt := range fields[1:] {
+			if err := user.setOption(opt); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", filename, lineNumber, err)
+			}
+		}
+		users[name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (u *User) setOption(opt string) error {
+	key, val, ok := strings.Cut(opt, "=")
+	if !ok {
+		return errors.New("expected option=value, got " + opt)
+	}
+	n, err := parseSize(val)
+	if err != nil {
+		return fmt.Errorf("bad %s: %w", key, err)
+	}
+	switch key {
+	case "bw":
+		u.Up, u.Down = newBandwidth(n), newBandwidth(n)
+	case "bwup":
+		u.Up = newBandwidth(n)
+	case "bwdown":
+		u.Down = newBandwidth(n)
+	case "quota":
+		u.Quota = n
+	default:
+		return errors.New("unknown option " + key)
+	}
+	return nil
+}
+
+// parses a byte count like "512", "64K" or "10G" (powers of 1024)
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		case "T":
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("negative size")
+	}
+	return n * mult, nil
+}
+
+// makes a bucket for limiting bandwidth to rate bytes per second, nil if rate is 0
+func newBandwidth(rate int64) *limiter.Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return limiter.NewBucket(float64(rate), int(rate))
+}
+
+var errAuth = errors.New("authentication failed")
+
+// does socks5 method negotiation (and username/password auth if users is not nil).
+// returns the authenticated user, nil if auth is off
+func negotiate(conn net.Conn, users map[string]*User) (*User, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0x05 {
+		return nil, errors.New("not socks5")
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	var method byte = 0x00 // no authentication required
+	if users != nil {
+		method = 0x02 // username/password
+	}
+	if !slices.Contains(methods, method) {
+		conn.Write([]byte{0x05, 0xff})
+		return nil, errors.New("no acceptable methods")
+	}
+	if _, err := conn.Write([]byte{0x05, method}); err != nil {
+		return nil, err
+	}
+	if users == nil {
+		return nil, nil
+	}
+
+	// rfc 1929
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0x01 {
+		return nil, errors.New("bad auth version")
+	}
+	uname := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, hdr[:1]); err != nil {
+		return nil, err
+	}
+	passwd := make([]byte, hdr[0])
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return nil, err
+	}
+
+	user, ok := users[string(uname)]
+	if !ok || subtle.ConstantTimeCompare([]byte(user.Pass), passwd) != 1 {
+		conn.Write([]byte{0x01, 0x01})
+		return nil, errAuth
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// starts a new quota period for all users every period until ctx is done
+func renewQuotas(ctx context.Context, users map[string]*User, period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for _, u := range users {
+				u.used.Store(0)
+			}
+			logging.Info("users' quotas are renewed")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
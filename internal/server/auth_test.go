@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// credentials message of rfc 1929
+func authMsg(user, pass string) []byte {
+	msg := []byte{0x01, byte(len(user))}
+	msg = append(msg, user...)
+	msg = append(msg, byte(len(pass)))
+	return append(msg, pass...)
+}
+
+func TestNegotiate(t *testing.T) {
+	users := map[string]*User{"alice": {Name: "alice", Pass: "secret"}}
+	greet := func(methods ...byte) []byte {
+		return append([]byte{0x05, byte(len(methods))}, methods...)
+	}
+	tests := []struct {
+		name   string
+		users  map[string]*User
+		client []byte
+		reply  []byte // what the server answers
+		user   string // who is authenticated, empty if nobody
+		err    error  // errAuth, or nil if any other error is expected
+		ok     bool
+	}{
+		{"no auth", nil, greet(0x00), []byte{0x05, 0x00}, "", nil, true},
+		{"no auth among others", nil, greet(0x02, 0x00, 0x01), []byte{0x05, 0x00}, "", nil, true},
+		{"only password offered", nil, greet(0x02), []byte{0x05, 0xff}, "", nil, false},
+		{"not socks5", nil, []byte{0x04, 0x01, 0x00, 0x50}, nil, "", nil, false},
+		{"password", users, append(greet(0x00, 0x02), authMsg("alice", "secret")...),
+			[]byte{0x05, 0x02, 0x01, 0x00}, "alice", nil, true},
+		{"password required", users, greet(0x00), []byte{0x05, 0xff}, "", nil, false},
+		{"wrong password", users, append(greet(0x02), authMsg("alice", "guess")...),
+			[]byte{0x05, 0x02, 0x01, 0x01}, "", errAuth, false},
+		{"unknown user", users, append(greet(0x02), authMsg("bob", "secret")...),
+			[]byte{0x05, 0x02, 0x01, 0x01}, "", errAuth, false},
+		{"empty password", users, append(greet(0x02), authMsg("alice", "")...),
+			[]byte{0x05, 0x02, 0x01, 0x01}, "", errAuth, false},
+		{"bad auth version", users, append(greet(0x02), 0x05, 0x05, 'a', 'l', 'i', 'c', 'e', 0x06, 's', 'e', 'c', 'r', 'e', 't'),
+			[]byte{0x05, 0x02}, "", nil, false},
+		{"truncated credentials", users, append(greet(0x02), 0x01, 0x05, 'a', 'l'), []byte{0x05, 0x02}, "", nil, false},
+	}
+	for _, tt := range tests {
+		client, conn := net.Pipe()
+		client.SetDeadline(time.Now().Add(time.Second))
+		conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		go client.Write(tt.client)
+		type result struct {
+			user *User
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			user, err := negotiate(conn, tt.users)
+			conn.Close()
+			done <- result{user, err}
+		}()
+		reply, _ := io.ReadAll(client)
+		client.Close()
+		res := <-done
+
+		if !bytes.Equal(reply, tt.reply) {
+			t.Errorf("%s: replied % x, want % x", tt.name, reply, tt.reply)
+		}
+		if tt.ok != (res.err == nil) || tt.err != nil && !errors.Is(res.err, tt.err) {
+			t.Errorf("%s: error %v", tt.name, res.err)
+		}
+		var name string
+		if res.user != nil {
+			name = res.user.Name
+		}
+		if name != tt.user {
+			t.Errorf("%s: authenticated %q, want %q", tt.name, name, tt.user)
+		}
+	}
+}
+
+func TestLoadUsers(t *testing.T) {
+	tests := []struct {
+		file  string
+		users map[string]string
+		err   string
+	}{
+		{"# clients\nalice:secret\n\nbob:pa:ss # colons are in the password\n", map[string]string{"alice": "secret", "bob": "pa:ss"}, ""},
+		{"carol:\n", map[string]string{"carol": ""}, ""},
+		{"alice\n", nil, ":1: expected name:password"},
+		{":secret\n", nil, ":1: expected name:password"},
+		{"alice:a\nalice:b\n", nil, ":2: duplicate user alice"},
+		{"alice:" + strings.Repeat("x", 256) + "\n", nil, ":1: expected name:password"},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(t.TempDir(), "users")
+		if err := os.WriteFile(name, []byte(tt.file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		users, err := LoadUsers(name)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: error %v, want %q", tt.file, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.file, err)
+			continue
+		}
+		if len(users) != len(tt.users) {
+			t.Errorf("%q: %d users, want %d", tt.file, len(users), len(tt.users))
+		}
+		for n, pass := range tt.users {
+			if u := users[n]; u == nil || u.Name != n || u.Pass != pass {
+				t.Errorf("%q: user %s is %+v", tt.file, n, u)
+			}
+		}
+	}
+}
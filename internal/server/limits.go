@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"github.com/etidart/proxyflow/internal/limiter"
+)
+
+// limits on client connections, nil members are disabled
+type limits struct {
+	conns   *limiter.Counter // all connections, single key
+	perIP   *limiter.Counter
+	perUser *limiter.Counter
+	rate    *limiter.Buckets // new connections per client ip
+}
+
+func newLimits(cfg *Config) *limits {
+	l := &limits{}
+	if cfg.MaxConns > 0 {
+		l.conns = limiter.NewCounter(cfg.MaxConns)
+	}
+	if cfg.MaxConnsPerIP > 0 {
+		l.perIP = limiter.NewCounter(cfg.MaxConnsPerIP)
+	}
+	if cfg.MaxConnsPerUser > 0 {
+		l.perUser = limiter.NewCounter(cfg.MaxConnsPerUser)
+	}
+	if cfg.ConnRate > 0 {
+		l.rate = limiter.NewBuckets(cfg.ConnRate, max(cfg.ConnBurst, 1))
+	}
+	return l
+}
+
+// checks a new connection from ip against the limits which don't depend on the user,
+// before anything is read from it. if it is admitted, reason is empty and release must
+// be called when the connection ends
+func (l *limits) admit(ip string) (release func(), reason string) {
+	if !l.rate.Allow(ip) {
+		return nil, "limit_rate"
+	}
+	if !l.conns.Acquire("") {
+		return nil, "limit_conns"
+	}
+	if !l.perIP.Acquire(ip) {
+		l.conns.Release("")
+		return nil, "limit_conns_ip"
+	}
+	return func() {
+		l.perIP.Release(ip)
+		l.conns.Release("")
+	}, ""
+}
+
+// checks a connection of user against the per user limit once the client has
+// authenticated, release is like admit's
+func (l *limits) admitUser(user string) (release func(), reason string) {
+	if !l.perUser.Acquire(user) {
+		return nil, "limit_conns_user"
+	}
+	return func() { l.perUser.Release(user) }, ""
+}
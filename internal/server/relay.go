@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+	"github.com/etidart/proxyflow/internal/limiter"
+	"github.com/etidart/proxyflow/internal/metrics"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relays data between the client and the upstream until both directions are done,
+// nothing moves for idle or the relay lives for lifetime (0 disables either of them).
+// returns why it ended
+func relay(conn, pconn net.Conn, up, down *meter, idle, lifetime time.Duration) string {
+	var reason string
+	var once, closeOnce sync.Once
+	finish := func(r string) {
+		once.Do(func() { reason = r })
+	}
+	stopped := make(chan struct{})
+	up.stop, down.stop = stopped, stopped
+	closeBoth := func() {
+		closeOnce.Do(func() { close(stopped) })
+		conn.Close()
+		pconn.Close()
+	}
+
+	// one direction finished: pass the eof on if both sides can half-close, otherwise end everything
+	halfClose := func(to net.Conn, err error) {
+		if err == nil {
+			if cw, ok := to.(closeWriter); ok && cw.CloseWrite() == nil {
+				return
+			}
+		}
+		closeBoth()
+	}
+
+	var control sync.WaitGroup
+	control.Add(2)
+	go func() {
+		defer control.Done()
+		_, err := io.Copy(down, pconn)
+		finish(closeReason("upstream", err))
+		halfClose(conn, err)
+	}()
+	go func() {
+		defer control.Done()
+		_, err := io.Copy(up, conn)
+		finish(closeReason("client", err))
+		halfClose(pconn, err)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		control.Wait()
+		close(done)
+	}()
+
+	var idleC, lifeC <-chan time.Time
+	var idleTimer *time.Timer
+	if idle > 0 {
+		up.activity.Store(time.Now().UnixNano())
+		idleTimer = time.NewTimer(idle)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+	if lifetime > 0 {
+		lifeTimer := time.NewTimer(lifetime)
+		defer lifeTimer.Stop()
+		lifeC = lifeTimer.C
+	}
+	for {
+		select {
+		case <-done:
+			return reason
+		case <-idleC:
+			left := idle - time.Since(time.Unix(0, up.activity.Load()))
+			if left > 0 {
+				idleTimer.Reset(left)
+				continue
+			}
+			finish("idle_timeout")
+			closeBoth()
+		case <-lifeC:
+			finish("max_lifetime")
+			closeBoth()
+		}
+	}
+}
+
+// describes why the relay ended, side is the one whose copy finished first
+func closeReason(side string, err error) string {
+	if err != nil {
+		return side + "_error"
+	}
+	return side + "_closed"
+}
+
+var errRelayStopped = errors.New("relay is stopped")
+
+// meter counts bytes written through it and the time spent transferring them
+// (pauses longer than SRVTPUTMAXGAP are not counted). it also holds writes back
+// to keep within the bandwidth of its buckets
+type meter struct {
+	w        io.Writer
+	dir      string        // direction label for RelayedBytes
+	activity *atomic.Int64 // time of the last write in unix nanoseconds, shared by both directions
+	buckets  []*limiter.Bucket
+	user     *User         // whose quota the bytes count towards, nil if auth is off
+	stop     chan struct{} // closed when waiting for the buckets should be given up
+	n        int64
+	busy     time.Duration
+	last     time.Time
+
+	throttled bool // some writes were held back, so busy tells about the limits rather than the proxy
+}
+
+// waits until the buckets allow writing n bytes
+func (m *meter) throttle(n int) error {
+	var wait time.Duration
+	for _, b := range m.buckets {
+		wait = max(wait, b.Take(n))
+	}
+	if wait == 0 {
+		return nil
+	}
+	m.throttled = true
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-m.stop:
+		return errRelayStopped
+	}
+}
+
+func (m *meter) Write(p []byte) (int, error) {
+	if err := m.throttle(len(p)); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	if !m.last.IsZero() {
+		if gap := now.Sub(m.last); gap < constants.SRVTPUTMAXGAP {
+			m.busy += gap
+		}
+	}
+	n, err := m.w.Write(p)
+	m.last = time.Now()
+	m.busy += m.last.Sub(now)
+	m.n += int64(n)
+	m.activity.Store(m.last.UnixNano())
+	if m.user != nil {
+		m.user.used.Add(int64(n))
+	}
+	metrics.RelayedBytes.Add(float64(n), m.dir)
+	return n, err
+}
+
+// returns the buckets which aren't nil
+func buckets(bs ...*limiter.Bucket) []*limiter.Bucket {
+	var res []*limiter.Bucket
+	for _, b := range bs {
+		if b != nil {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+func userBucket(user *User, up bool) *limiter.Bucket {
+	switch {
+	case user == nil:
+		return nil
+	case up:
+		return user.Up
+	default:
+		return user.Down
+	}
+}
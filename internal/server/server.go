@@ -12,16 +12,21 @@
 package server
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/etidart/proxyflow/internal/connector"
 	"github.com/etidart/proxyflow/internal/constants"
+	"github.com/etidart/proxyflow/internal/limiter"
 	"github.com/etidart/proxyflow/internal/logging"
+	"github.com/etidart/proxyflow/internal/metrics"
 	"github.com/etidart/proxyflow/internal/proxy"
 )
 
@@ -37,46 +42,235 @@ const (
 	ADDRTYPEERR    byte = 0x08
 )
 
-func ListenAndServe(listenon string, rqc chan<- chan proxy.Message) {
-	listener, err := net.Listen("tcp", listenon)
+// Config is the listener configuration
+type Config struct {
+	Listen    string
+	Users     map[string]*User // nil disables authentication
+	AccessLog *AccessLog       // nil disables the access log
+	ACL       *ACL             // nil allows everyone everything
+	Grace     time.Duration    // how long active relays are waited for on shutdown
+
+	IdleTimeout time.Duration // relays with no traffic for this long are closed, 0 disables
+	MaxLifetime time.Duration // relays are closed after this long, 0 disables
+
+	MaxConns        int     // concurrent client connections, 0 is unlimited
+	MaxConnsPerIP   int     // concurrent connections from one client ip, 0 is unlimited
+	MaxConnsPerUser int     // concurrent connections of one user, 0 is unlimited
+	ConnRate        float64 // new connections per second from one client ip, 0 is unlimited
+	ConnBurst       int     // how many connections over ConnRate a client ip can open at once
+
+	MaxUp       int64         // bandwidth from all clients in bytes per second, 0 is unlimited
+	MaxDown     int64         // bandwidth to all clients in bytes per second, 0 is unlimited
+	PrxMaxUp    int64         // bandwidth to one proxy in bytes per second, 0 is unlimited
+	PrxMaxDown  int64         // bandwidth from one proxy in bytes per second, 0 is unlimited
+	QuotaPeriod time.Duration // how often users' quotas are renewed
+}
+
+// ListenAndServe serves clients until ctx is done. then it stops accepting,
+// waits up to cfg.Grace for active relays to finish and closes the rest
+func ListenAndServe(ctx context.Context, cfg *Config, pm *proxy.ProxyManager) {
+	listener, err := net.Listen("tcp", cfg.Listen)
 	if err != nil {
-		logging.Fatal("listener: " + err.Error())
+		logging.Fatal("unable to listen", "listen", cfg.Listen, "error", err)
+	}
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	logging.Info("started listening", "listen", cfg.Listen, "auth", cfg.Users != nil)
+
+	s := &srv{
+		cfg:    cfg,
+		pm:     pm,
+		conns:  make(map[net.Conn]struct{}),
+		limits: newLimits(cfg),
+		up:     newBandwidth(cfg.MaxUp),
+		down:   newBandwidth(cfg.MaxDown),
+	}
+	if cfg.PrxMaxUp > 0 {
+		s.prxUp = limiter.NewBuckets(float64(cfg.PrxMaxUp), int(cfg.PrxMaxUp))
+	}
+	if cfg.PrxMaxDown > 0 {
+		s.prxDown = limiter.NewBuckets(float64(cfg.PrxMaxDown), int(cfg.PrxMaxDown))
+	}
+	if cfg.Users != nil && cfg.QuotaPeriod > 0 {
+		go renewQuotas(ctx, cfg.Users, cfg.QuotaPeriod)
 	}
-	defer listener.Close()
-	logging.Info("Started listening on " + listenon)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			logging.Warn("error while accepting connection: " + err.Error())
+			if ctx.Err() != nil {
+				break
+			}
+			logging.Warn("error while accepting connection", "error", err)
+			continue
+		}
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		release, reason := s.limits.admit(ip)
+		if reason != "" {
+			s.refuse(conn, reason)
 			continue
 		}
-		go handleConn(conn, rqc)
+		s.track(conn)
+		go func() {
+			defer s.untrack(conn)
+			defer release()
+			s.handleConn(conn)
+		}()
 	}
+	s.drain()
 }
 
-func handleConn(conn net.Conn, rqc chan<- chan proxy.Message) {
-	defer conn.Close()
-	buff := make([]byte, 4096)
-	_, err := conn.Read(buff)
-	if err != nil {
+// srv is the state shared by connections of one listener
+type srv struct {
+	cfg *Config
+	pm  *proxy.ProxyManager
+
+	limits  *limits
+	up      *limiter.Bucket  // listener's bandwidth, nil is unlimited
+	down    *limiter.Bucket  // listener's bandwidth, nil is unlimited
+	prxUp   *limiter.Buckets // per proxy bandwidth, nil is unlimited
+	prxDown *limiter.Buckets // per proxy bandwidth, nil is unlimited
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{} // client and upstream connections which are open
+	active sync.WaitGroup        // running handleConn calls
+	forced atomic.Bool           // set when the grace period ran out
+
+	refusing atomic.Int32 // connections over the limits waiting for their "not allowed" reply
+}
+
+// answers a connection which is over the limits with NOTALLOWED once the client
+// has sent its request. up to SRVMAXREFUSING clients are waited for at once, the
+// ones over that (a flood, most likely) are just disconnected
+func (s *srv) refuse(conn net.Conn, reason string) {
+	if s.refusing.Add(1) > constants.SRVMAXREFUSING {
+		s.refusing.Add(-1)
+		logging.Debug("connection is not allowed", "client", conn.RemoteAddr().String(), "reason", reason)
+		metrics.ServerFailures.Inc(reason)
+		conn.Close()
 		return
 	}
-	if buff[0] != 0x05 {
+	s.track(conn)
+	go func() {
+		defer s.untrack(conn)
+		defer s.refusing.Add(-1)
+		defer conn.Close()
+		sess := &session{client: conn.RemoteAddr().String()}
+		conn.SetDeadline(time.Now().Add(constants.SRVREFUSETO))
+		user, err := negotiate(conn, s.cfg.Users)
+		if err == nil {
+			if user != nil {
+				sess.user = user.Name
+			}
+			_, err = conn.Read(make([]byte, 4096))
+		}
+		if err != nil {
+			logging.Debug("connection is not allowed", "client", sess.client, "reason", reason)
+			metrics.ServerFailures.Inc(reason)
+			return
+		}
+		reject(conn, sess, reason)
+	}()
+}
+
+func (s *srv) track(conn net.Conn) {
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.active.Add(1)
+	s.mu.Unlock()
+}
+
+func (s *srv) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.active.Done()
+}
+
+// tracks an upstream connection so that drain can close it, returns the untracking func
+func (s *srv) trackUpstream(pconn net.Conn) func() {
+	s.mu.Lock()
+	if s.forced.Load() {
+		// drain has already closed everything else
+		pconn.Close()
+	}
+	s.conns[pconn] = struct{}{}
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.conns, pconn)
+		s.mu.Unlock()
+	}
+}
+
+// waits for active connections up to the grace period, then closes them
+func (s *srv) drain() {
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	s.mu.Lock()
+	n := len(s.conns)
+	s.mu.Unlock()
+	logging.Info("stopped listening, waiting for active connections", "listen", s.cfg.Listen, "connections", n, "grace", s.cfg.Grace)
+
+	select {
+	case <-done:
 		return
+	case <-time.After(s.cfg.Grace):
 	}
-	_, err = conn.Write([]byte{0x05, 0x00})
+
+	s.forced.Store(true)
+	s.mu.Lock()
+	logging.Warn("grace period is over, closing active connections", "connections", len(s.conns))
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+}
+
+func (s *srv) handleConn(conn net.Conn) {
+	cfg, pm := s.cfg, s.pm
+	defer conn.Close()
+	metrics.ClientConns.Inc()
+	defer metrics.ClientConns.Dec()
+	sess := &session{client: conn.RemoteAddr().String(), start: time.Now()}
+	defer func() {
+		// only requests which got as far as naming a target are logged
+		if sess.target != "" {
+			cfg.AccessLog.write(sess)
+		}
+	}()
+	// a client gets SRVCLIHSTO to authenticate and send its request
+	conn.SetDeadline(time.Now().Add(constants.SRVCLIHSTO))
+	user, err := negotiate(conn, cfg.Users)
 	if err != nil {
+		if errors.Is(err, errAuth) {
+			metrics.ServerFailures.Inc("auth")
+			logging.Warn("client failed authentication", "client", sess.client)
+		}
 		return
 	}
+	if user != nil {
+		sess.user = user.Name
+	}
+	buff := make([]byte, 4096)
 	_, err = conn.Read(buff)
 	if err != nil {
 		return
 	}
+	conn.SetDeadline(time.Time{})
 	// parsing
 	if buff[0] != 0x05 || buff[1] != 0x01 || buff[2] != 0x00 {
 		endHandshake(PROTOERR, conn)
 		return
 	}
+	ip, _, _ := net.SplitHostPort(sess.client)
+	if !cfg.ACL.allowClient(net.ParseIP(ip)) {
+		reject(conn, sess, "acl_client")
+		return
+	}
 
 	var rqhost connector.ConnectWho
 	var hosttodisplay string
@@ -85,15 +279,18 @@ func handleConn(conn net.Conn, rqc chan<- chan proxy.Message) {
 		rqhost.IP = fmt.Sprintf("%d.%d.%d.%d", buff[4], buff[5], buff[6], buff[7])
 		rqhost.Port = binary.BigEndian.Uint16(buff[8:10])
 		hosttodisplay = fmt.Sprintf("%s:%d", rqhost.IP, rqhost.Port)
+		sess.target = hosttodisplay
 	case 0x03: // hostname
 		size := buff[4]
 		host := string(buff[5 : 5+size])
 		rqhost.Port = binary.BigEndian.Uint16(buff[5+size : 7+size])
 		hosttodisplay = fmt.Sprintf("%s:%d", host, rqhost.Port)
+		sess.target = hosttodisplay
 		ipAddrs, err := net.LookupIP(host)
 		if err != nil {
 			endHandshake(HOSTUNREACH, conn)
-			logging.Warn("unable to lookup host's ip from request: " + host + "; error:" + err.Error())
+			logging.Warn("unable to lookup host's ip from request", "client", sess.client, "target", host, "error", err)
+			sess.reason = "unresolved"
 			return
 		}
 		for _, ip := range ipAddrs {
@@ -103,69 +300,203 @@ func handleConn(conn net.Conn, rqc chan<- chan proxy.Message) {
 		}
 		if rqhost.IP == "" {
 			endHandshake(HOSTUNREACH, conn)
-			logging.Warn("unable to lookup host's ip from request: " + host)
+			logging.Warn("host from request has no ipv4 address", "client", sess.client, "target", host)
+			sess.reason = "unresolved"
 			return
 		}
 	default: // ipv6 and incorrect
 		endHandshake(ADDRTYPEERR, conn)
 		return
 	}
+	if !cfg.ACL.allowDest(net.ParseIP(rqhost.IP)) {
+		reject(conn, sess, "acl_dest")
+		return
+	}
+	if user != nil && user.overQuota() {
+		reject(conn, sess, "quota")
+		return
+	}
+	if sess.user != "" {
+		release, reason := s.limits.admitUser(sess.user)
+		if reason != "" {
+			reject(conn, sess, reason)
+			return
+		}
+		defer release()
+	}
+	// the client shouldn't send anything until it gets our reply, so a read
+	// returning an error means it has left and the handshake can be abandoned
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopWatching := watchClient(conn, cancel)
+
 	var pconn net.Conn
+	var lease *proxy.Lease
+	var hsdur time.Duration
+	var perr error
 	var retrynum uint8 = 0
-	for pconn = getpconn(rqc, &rqhost); pconn == nil; {
+	for pconn, lease, hsdur, perr = getpconn(ctx, pm, &rqhost); pconn == nil; pconn, lease, hsdur, perr = getpconn(ctx, pm, &rqhost) {
 		retrynum++
+		if ctx.Err() != nil {
+			break
+		}
 		if retrynum > constants.SRVMAXRETRIES {
-			logging.Error("unable to get proxy for request (" + hosttodisplay + "). dropping request...")
+			logging.Error("unable to get proxy for request, dropping it", "client", conn.RemoteAddr().String(), "target", hosttodisplay, errAttrs(perr))
 			break
 		} else {
-			logging.Error("unable to get proxy for request (" + hosttodisplay + "). retrying...")
-			time.Sleep(constants.SRVRETRYCD)
+			logging.Warn("unable to get proxy for request, retrying", "client", conn.RemoteAddr().String(), "target", hosttodisplay, "retry", retrynum, errAttrs(perr))
+			metrics.ServerRetries.Inc()
+			select {
+			case <-time.After(constants.SRVRETRYCD):
+			case <-ctx.Done():
+			}
+		}
+	}
+	early, alive := stopWatching()
+	var tput float64 // measured throughput, sent with the final report
+	if pconn != nil {
+		// every lease is given back with a final report
+		defer func() {
+			lease.Report(proxy.Result{Tput: tput})
+			lease.Release()
+		}()
+	}
+	if !alive {
+		if pconn != nil {
+			pconn.Close()
 		}
+		logging.Debug("client left during the handshake", "client", sess.client, "target", hosttodisplay)
+		sess.reason = "client_gone"
+		return
 	}
 	if pconn == nil {
-		endHandshake(GENERALFAILURE, conn)
+		if errors.Is(perr, proxy.ErrNoProxies) {
+			sess.reason = "no_proxies"
+		} else {
+			sess.reason = proxy.ClassOf(perr).String()
+		}
+		metrics.ServerFailures.Inc(sess.reason)
+		if proxy.ClassOf(perr) == proxy.ErrTargetUnreach {
+			endHandshake(HOSTUNREACH, conn)
+		} else {
+			endHandshake(GENERALFAILURE, conn)
+		}
 		return
 	}
 	defer pconn.Close()
+	defer s.trackUpstream(pconn)()
+	prx := lease.Prx
+	sess.proxy = prx.Address
+	sess.protocol = prx.Proto.String()
+	sess.hs = hsdur
 
 	if !endHandshake(REQUESTGRANTED, conn) {
-		logging.Warn(conn.RemoteAddr().String() + " suddenly closed the connection")
+		logging.Warn("client suddenly closed the connection", "client", sess.client, "target", hosttodisplay)
+		sess.reason = "client_gone"
 		return
 	}
-	logging.Info("accepted request from " + conn.RemoteAddr().String() + " (" + hosttodisplay + "; proxy: " + pconn.RemoteAddr().String() + ")")
+	logging.Debug("accepted request", "client", sess.client, "user", sess.user, "target", hosttodisplay, "proxy", prx.Address, "protocol", prx.Proto.String(), "duration", hsdur)
 
-	var control sync.WaitGroup
-	control.Add(2)
-	go func() {
-		defer control.Done()
-		io.Copy(conn, pconn)
-	}()
+	var activity atomic.Int64
+	prxKey := proxy.Key(prx)
+	defer s.prxDown.Release(prxKey)
+	defer s.prxUp.Release(prxKey)
+	down := &meter{w: conn, dir: "down", activity: &activity, user: user,
+		buckets: buckets(s.down, s.prxDown.Acquire(prxKey), userBucket(user, false))}
+	up := &meter{w: pconn, dir: "up", activity: &activity, user: user,
+		buckets: buckets(s.up, s.prxUp.Acquire(prxKey), userBucket(user, true))}
+	if len(early) > 0 {
+		if _, err := up.Write(early); err != nil {
+			sess.reason = "upstream_error"
+			return
+		}
+	}
+	sess.reason = relay(conn, pconn, up, down, cfg.IdleTimeout, cfg.MaxLifetime)
+	if s.forced.Load() {
+		sess.reason = "shutdown"
+	}
+	sess.up = up.n
+	sess.down = down.n
+	logging.Debug("relay finished", "client", sess.client, "user", sess.user, "target", hosttodisplay, "proxy", prx.Address, "protocol", prx.Proto.String(),
+		"reason", sess.reason, "up", sess.up, "down", sess.down, "duration", time.Since(sess.start))
+
+	if down.n >= constants.SRVTPUTMINBYTES && down.busy > 0 && !down.throttled {
+		tput = float64(down.n) / down.busy.Seconds()
+	}
+}
+
+// watches conn for the client leaving while we are busy with the upstream (cancel is called then).
+// stop ends the watching and returns what the client has sent meanwhile and whether it is still there
+func watchClient(conn net.Conn, cancel context.CancelFunc) (stop func() ([]byte, bool)) {
+	buff := make([]byte, 4096)
+	var n int
+	var err error
+	done := make(chan struct{})
 	go func() {
-		defer control.Done()
-		io.Copy(pconn, conn)
+		defer close(done)
+		n, err = conn.Read(buff)
+		if n == 0 && err != nil {
+			cancel()
+		}
 	}()
-	control.Wait()
+	return func() ([]byte, bool) {
+		conn.SetReadDeadline(time.Unix(1, 0)) // wakes the read up
+		<-done
+		conn.SetReadDeadline(time.Time{})
+		if n > 0 {
+			return buff[:n], true
+		}
+		var nerr net.Error
+		return nil, errors.As(err, &nerr) && nerr.Timeout()
+	}
 }
 
-func getpconn(rqc chan<- chan proxy.Message, rqhost *connector.ConnectWho) net.Conn {
-	c := make(chan proxy.Message)
-	rqc <- c
-	prx := (<-c).Prx
-	pconn, perr, ptime := connector.ConnectToPrx(prx, *rqhost)
-	if perr != "" {
-		c <- proxy.Message{
-			Prx: prx,
-			Err: perr,
-			Dur: 0,
-		}
-		return nil
+func getpconn(ctx context.Context, pm *proxy.ProxyManager, rqhost *connector.ConnectWho) (net.Conn, *proxy.Lease, time.Duration, error) {
+	lease, err := pm.Acquire(ctx, proxy.Criteria{Purpose: proxy.Relay})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	prx := lease.Prx
+	pconn, perr, ptime := connector.ConnectToPrx(ctx, prx, *rqhost)
+	if perr != nil {
+		lease.Report(proxy.Result{Err: perr})
+		lease.Release()
+		return nil, nil, 0, &proxyErr{prx: prx, err: perr}
 	}
-	c <- proxy.Message{
-		Prx: prx,
-		Err: "",
-		Dur: ptime,
+	lease.Report(proxy.Result{Dur: ptime})
+	return pconn, lease, ptime, nil
+}
+
+// proxyErr is an error of connecting through prx
+type proxyErr struct {
+	prx *proxy.Proxy
+	err error
+}
+
+func (e *proxyErr) Error() string {
+	return e.prx.Address + ": " + e.err.Error()
+}
+
+func (e *proxyErr) Unwrap() error {
+	return e.err
+}
+
+// returns log fields describing err: proxy, protocol and error class if they are known
+func errAttrs(err error) slog.Attr {
+	var perr *proxyErr
+	if errors.As(err, &perr) {
+		return slog.Group("", "proxy", perr.prx.Address, "protocol", perr.prx.Proto.String(),
+			"class", proxy.ClassOf(perr.err).String(), "error", perr.err.Error())
 	}
-	return pconn
+	return slog.String("error", err.Error())
+}
+
+// refuses a request with NOTALLOWED because of policy (acl, limits or quota)
+func reject(conn net.Conn, sess *session, reason string) {
+	endHandshake(NOTALLOWED, conn)
+	logging.Debug("request is not allowed", "client", sess.client, "user", sess.user, "target", sess.target, "reason", reason)
+	metrics.ServerFailures.Inc(reason)
+	sess.reason = reason
 }
 
 func endHandshake(status byte, conn net.Conn) bool {
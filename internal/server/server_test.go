@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/constants"
+)
+
+// plays a client without authentication sending a connect request to 198.51.100.1:80,
+// returns the reply's status
+func socksRequest(t *testing.T, conn net.Conn) byte {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(method, []byte{0x05, 0x00}) {
+		t.Fatalf("method reply % x", method)
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 198, 51, 100, 1, 0x00, 0x50}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func newTestSrv(cfg *Config) *srv {
+	return &srv{cfg: cfg, conns: make(map[net.Conn]struct{}), limits: newLimits(cfg)}
+}
+
+// a client over the limits gets a "not allowed" reply to its request
+func TestRefuse(t *testing.T) {
+	s := newTestSrv(&Config{})
+	client, conn := net.Pipe()
+	defer client.Close()
+	s.refuse(conn, "limit_conns")
+	if status := socksRequest(t, client); status != NOTALLOWED {
+		t.Errorf("status %#x, want NOTALLOWED", status)
+	}
+	s.active.Wait()
+	if n := s.refusing.Load(); n != 0 {
+		t.Errorf("%d refusals left after the reply", n)
+	}
+}
+
+// clients over SRVMAXREFUSING are disconnected without a reply
+func TestRefuseFlood(t *testing.T) {
+	s := newTestSrv(&Config{})
+	s.refusing.Store(constants.SRVMAXREFUSING)
+	client, conn := net.Pipe()
+	defer client.Close()
+	s.refuse(conn, "limit_rate")
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err == nil {
+		t.Error("the connection is still open")
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/checker"
+	"github.com/etidart/proxyflow/internal/constants"
+	"github.com/etidart/proxyflow/internal/logging"
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// Source is a proxy list which is fetched every Refresh and merged into the manager
+type Source struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`              // file, http or command
+	Path    string   `json:"path,omitempty"`    // for file
+	URL     string   `json:"url,omitempty"`     // for http (http or https url)
+	Command []string `json:"command,omitempty"` // for command: program and its args, the list is its stdout
+	Refresh string   `json:"refresh,omitempty"` // duration like "1h", empty fetches once
+	Format  string   `json:"format,omitempty"`  // list format, guessed by default
+	Proto   string   `json:"proto,omitempty"`   // protocol of entries without a scheme, "detect" probes them
+	Tags    []string `json:"tags,omitempty"`    // given to proxies from this source
+
+	Client *http.Client `json:"-"` // used by http sources, nil is a client with SRCFETCHTO timeout
+
+	refresh time.Duration
+}
+
+// Load reads a json array of sources from filename and validates them
+func Load(filename string) ([]*Source, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var sources []*Source
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(sources))
+	for i, src := range sources {
+		if src.Name == "" {
+			return nil, fmt.Errorf("source #%d has no name", i+1)
+		}
+		if _, dup := names[src.Name]; dup {
+			return nil, fmt.Errorf("duplicate source %s", src.Name)
+		}
+		names[src.Name] = struct{}{}
+		if err := src.init(); err != nil {
+			return nil, fmt.Errorf("source %s: %w", src.Name, err)
+		}
+	}
+	return sources, nil
+}
+
+func (src *Source) init() error {
+	switch src.Type {
+	case "file":
+		if src.Path == "" {
+			return errors.New("file source needs a path")
+		}
+	case "http":
+		if src.URL == "" {
+			return errors.New("http source needs a url")
+		}
+	case "command":
+		if len(src.Command) == 0 {
+			return errors.New("command source needs a command")
+		}
+	default:
+		return errors.New("unknown type " + src.Type)
+	}
+	if src.Format == "" {
+		src.Format = proxy.FormatAuto
+	}
+	if !proxy.IsFormat(src.Format) {
+		return errors.New("unknown format " + src.Format)
+	}
+	if src.Proto != "" && !proxy.IsProto(src.Proto) {
+		return errors.New("unknown protocol " + src.Proto)
+	}
+	if src.Refresh != "" {
+		d, err := time.ParseDuration(src.Refresh)
+		if err != nil {
+			return err
+		}
+		src.refresh = d
+	}
+	if src.Client == nil {
+		src.Client = &http.Client{Timeout: constants.SRCFETCHTO}
+	}
+	return nil
+}
+
+// returns the raw list
+func (src *Source) fetch(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, constants.SRCFETCHTO)
+	defer cancel()
+	switch src.Type {
+	case "file":
+		return os.ReadFile(src.Path)
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", constants.CONUSERAGENT)
+		resp, err := src.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return nil, errors.New("server answered " + resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, constants.SRCMAXSIZE))
+	case "command":
+		return exec.CommandContext(ctx, src.Command[0], src.Command[1:]...).Output()
+	}
+	return nil, errors.New("unknown type " + src.Type)
+}
+
+// fetches the list and merges it into pm. if it can't be fetched, parsed or
+// merged, proxies from the previous refresh stay. strict makes any bad entry a parsing error
+func (src *Source) refreshOnce(ctx context.Context, pm *proxy.ProxyManager, strict bool) error {
+	data, err := src.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching: %w", err)
+	}
+	proxies, err := proxy.Parse(data, proxy.ParseOptions{
+		Format: src.Format,
+		Name:   src.Name,
+		Proto:  src.Proto,
+		Strict: strict,
+		Detect: checker.Detector(ctx, constants.SRCDETECTN),
+	})
+	if err != nil {
+		return fmt.Errorf("parsing: %w", err)
+	}
+	if len(proxies) == 0 {
+		return errors.New("list has no proxies")
+	}
+	for _, prx := range proxies {
+		// pool files can tag proxies themselves
+		prx.Tags = append(slices.Clip(src.Tags), prx.Tags...)
+	}
+	added, removed, err := pm.SetSource(src.Name, proxies)
+	if err != nil {
+		return err
+	}
+	logging.Info("source refreshed", "source", src.Name, "proxies", len(proxies), "added", added, "removed", removed)
+	return nil
+}
+
+// RefreshAll fetches every source once, errors are logged. in strict mode the first
+// list with bad entries is returned as a ListError instead
+func RefreshAll(ctx context.Context, pm *proxy.ProxyManager, sources []*Source, strict bool) error {
+	for _, src := range sources {
+		err := src.refreshOnce(ctx, pm, strict)
+		var lerr proxy.ListError
+		if errors.As(err, &lerr) {
+			return lerr
+		}
+		if err != nil {
+			logging.Error("unable to refresh source", "source", src.Name, "error", err)
+		}
+	}
+	return nil
+}
+
+// Serve refreshes each source every its Refresh until ctx is done
+func Serve(ctx context.Context, pm *proxy.ProxyManager, sources []*Source) {
+	for _, src := range sources {
+		if src.refresh <= 0 {
+			continue
+		}
+		go func() {
+			t := time.NewTicker(src.refresh)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					return
+				}
+				if err := src.refreshOnce(ctx, pm, false); err != nil {
+					logging.Error("unable to refresh source", "source", src.Name, "error", err)
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package source
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// list is an http server whose answer can be changed between fetches
+type list struct {
+	mu     sync.Mutex
+	status int
+	body   string
+}
+
+func (l *list) set(status int, body string) {
+	l.mu.Lock()
+	l.status, l.body = status, body
+	l.mu.Unlock()
+}
+
+func (l *list) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w.WriteHeader(l.status)
+	w.Write([]byte(l.body))
+}
+
+func newList(t *testing.T, body string) (*list, *httptest.Server) {
+	l := &list{status: http.StatusOK, body: body}
+	srv := httptest.NewServer(l)
+	t.Cleanup(srv.Close)
+	return l, srv
+}
+
+func newHTTPSource(t *testing.T, name, url string) *Source {
+	src := &Source{Name: name, Type: "http", URL: url, Tags: []string{"t"}}
+	if err := src.init(); err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func addresses(pm *proxy.ProxyManager) []string {
+	var addrs []string
+	for _, prx := range pm.List() {
+		addrs = append(addrs, prx.Address)
+	}
+	slices.Sort(addrs)
+	return addrs
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		json string
+		err  string
+	}{
+		{`[{"name": "a", "type": "http", "url": "http://example.com/", "refresh": "1h"}]`, ""},
+		{`[{"name": "a", "type": "file", "path": "list.txt", "format": "clash", "proto": "socks5"}]`, ""},
+		{`[{"name": "a", "type": "command", "command": ["true"]}]`, ""},
+		{`[{"type": "file", "path": "list.txt"}]`, "has no name"},
+		{`[{"name": "a", "type": "file", "path": "a"}, {"name": "a", "type": "file", "path": "b"}]`, "duplicate source"},
+		{`[{"name": "a", "type": "ftp"}]`, "unknown type"},
+		{`[{"name": "a", "type": "file"}]`, "needs a path"},
+		{`[{"name": "a", "type": "http"}]`, "needs a url"},
+		{`[{"name": "a", "type": "command"}]`, "needs a command"},
+		{`[{"name": "a", "type": "file", "path": "a", "format": "csv"}]`, "unknown format"},
+		{`[{"name": "a", "type": "file", "path": "a", "proto": "ftp"}]`, "unknown protocol"},
+		{`[{"name": "a", "type": "file", "path": "a", "refresh": "often"}]`, "invalid duration"},
+		{`{"name": "a"}`, "cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(t.TempDir(), "sources.json")
+		if err := os.WriteFile(name, []byte(tt.json), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		sources, err := Load(name)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.json, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		for _, src := range sources {
+			if src.Client == nil || !proxy.IsFormat(src.Format) {
+				t.Errorf("%s: source isn't initialized: %+v", tt.json, src)
+			}
+		}
+	}
+}
+
+func TestLoadRefresh(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "sources.json")
+	data := `[{"name": "a", "type": "file", "path": "a", "refresh": "90s"}, {"name": "b", "type": "file", "path": "b"}]`
+	if err := os.WriteFile(name, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sources[0].refresh != 90*time.Second || sources[1].refresh != 0 {
+		t.Errorf("refresh is %v and %v, want 1m30s and 0", sources[0].refresh, sources[1].refresh)
+	}
+	if sources[0].Format != proxy.FormatAuto {
+		t.Errorf("format %q, want auto", sources[0].Format)
+	}
+}
+
+// refreshes add and remove proxies, failed ones keep the previous list
+func TestRefreshOnce(t *testing.T) {
+	l, srv := newList(t, "socks5://203.0.113.1:1080\nsocks5://203.0.113.2:1080\n")
+	src := newHTTPSource(t, "vendor", srv.URL)
+	pm := proxy.NewProxyManager()
+	ctx := context.Background()
+
+	steps := []struct {
+		status int
+		body   string
+		err    string
+		want   []string
+	}{
+		{http.StatusOK, "", "", []string{"203.0.113.1:1080", "203.0.113.2:1080"}},
+		{http.StatusOK, "socks5://203.0.113.2:1080\nhttp://203.0.113.3:8080\n", "", []string{"203.0.113.2:1080", "203.0.113.3:8080"}},
+		{http.StatusInternalServerError, "oops", "server answered 500", []string{"203.0.113.2:1080", "203.0.113.3:8080"}},
+		{http.StatusOK, "", "no proxies", []string{"203.0.113.2:1080", "203.0.113.3:8080"}},
+		{http.StatusOK, "# nothing for now\n", "no proxies", []string{"203.0.113.2:1080", "203.0.113.3:8080"}},
+		{http.StatusOK, "socks5://203.0.113.4:1080\n", "", []string{"203.0.113.4:1080"}},
+	}
+	for i, step := range steps {
+		if i > 0 {
+			l.set(step.status, step.body)
+		}
+		err := src.refreshOnce(ctx, pm, false)
+		if step.err == "" && err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if step.err != "" && (err == nil || !strings.Contains(err.Error(), step.err)) {
+			t.Fatalf("step %d: error %v, want %q", i, err, step.err)
+		}
+		if got := addresses(pm); !slices.Equal(got, step.want) {
+			t.Fatalf("step %d: proxies %v, want %v", i, got, step.want)
+		}
+	}
+	for _, prx := range pm.List() {
+		if !slices.Equal(prx.Tags, []string{"t"}) {
+			t.Errorf("%s has tags %v, want the source's", prx.Address, prx.Tags)
+		}
+	}
+}
+
+// a source which is down doesn't stop the others, a bad list in strict mode does
+func TestRefreshAll(t *testing.T) {
+	_, good := newList(t, "socks5://203.0.113.1:1080\n")
+	down, bad := newList(t, "")
+	down.set(http.StatusNotFound, "")
+	sources := []*Source{newHTTPSource(t, "down", bad.URL), newHTTPSource(t, "good", good.URL)}
+	pm := proxy.NewProxyManager()
+	if err := RefreshAll(context.Background(), pm, sources, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(pm); !slices.Equal(got, []string{"203.0.113.1:1080"}) {
+		t.Errorf("proxies %v", got)
+	}
+
+	down.set(http.StatusOK, "socks5://203.0.113.2:1080\nnot a proxy\n")
+	err := RefreshAll(context.Background(), proxy.NewProxyManager(), sources, true)
+	var lerr proxy.ListError
+	if !errors.As(err, &lerr) || len(lerr) != 1 {
+		t.Errorf("strict refresh: %v, want a ListError with one entry", err)
+	}
+	if err := RefreshAll(context.Background(), pm, sources, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(pm); !slices.Equal(got, []string{"203.0.113.1:1080", "203.0.113.2:1080"}) {
+		t.Errorf("lenient refresh: proxies %v", got)
+	}
+}
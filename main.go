@@ -12,33 +12,252 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/etidart/proxyflow/internal/admin"
 	"github.com/etidart/proxyflow/internal/checker"
+	"github.com/etidart/proxyflow/internal/constants"
 	"github.com/etidart/proxyflow/internal/logging"
+	"github.com/etidart/proxyflow/internal/metrics"
 	"github.com/etidart/proxyflow/internal/proxy"
 	"github.com/etidart/proxyflow/internal/server"
+	"github.com/etidart/proxyflow/internal/source"
 )
 
 func main() {
-	logging.Init()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		case "convert":
+			runConvert(os.Args[2:])
+			return
+		}
+	}
+
 	pfile := flag.String("pfile", "", "path to file containing proxies")
+	pproto := flag.String("pproto", "", "protocol of pfile entries without a scheme (ip:port or ip:port:user:pass): http, https, socks4, socks5, or detect to probe each. empty makes them bad entries")
+	strict := flag.Bool("strict", false, "fail on start if the pfile or a source has a bad entry (unknown proto, bad address or option, duplicate)")
+	sourcesfile := flag.String("sources", "", "path to json file with proxy list sources (file, http or command) refreshed periodically")
 	checkingn := flag.Int("chkth", 10, "number of threads in checking pool")
 	listenon := flag.String("listen", "127.0.0.1:1080", "address to listen on")
+	bwurl := flag.String("bwurl", "", "url (http or https) to download from while measuring proxies' throughput, empty disables bandwidth probes")
+	bwsize := flag.Int64("bwsize", 1<<20, "how many bytes to download in each bandwidth probe")
+	bwint := flag.Duration("bwint", 10*time.Minute, "how often each proxy gets a bandwidth probe")
+	bwweight := flag.Float64("bwweight", 1, "how much throughput matters in proxy ranking compared to latency, 0 ranks by latency only")
+	ewma := flag.Float64("ewma", constants.PRXEWMAALPHA, "weight (0..1] of a new sample in proxies' latency and throughput estimates")
+	penalty := flag.String("penalty", "", "comma-separated overrides of error classes' weights in breakers' failure rate, e.g. \"target=0,refused=2\" (classes: dial, timeout, tls, auth, proto, refused, target, check, io, canceled)")
+	brkwindow := flag.Int("brkwindow", constants.PRXBRKWINDOW, "how many last outcomes each proxy's circuit breaker keeps")
+	brkmin := flag.Int("brkmin", constants.PRXBRKMINSAMPLES, "how many outcomes must be in the window before a breaker can trip")
+	brkrate := flag.Float64("brkrate", constants.PRXBRKFAILRATE, "failure rate which trips a breaker")
+	brkcd := flag.Duration("brkcd", constants.PRXBRKCD, "how long a tripped breaker waits before letting trial traffic through (doubles after each failed trial)")
+	promote := flag.Uint("promote", constants.PRXPROMOTESUCC, "how many successful trials in a row bring a bad proxy back")
+	maxdead := flag.Duration("maxdead", constants.PRXMAXDEAD, "how long a proxy can stay bad before it is dropped for good, 0 keeps bad proxies forever")
+	exitipurl := flag.String("exitipurl", "", "url (http or https) answering with client's ip in plain text, used to learn proxies' exit ips. empty disables")
+	exitipint := flag.Duration("exitipint", time.Hour, "how often each proxy's exit ip is learned")
+	statsint := flag.Duration("statsint", 0, "how often to log pool statistics, 0 disables")
+	metricson := flag.String("metrics", "", "address to serve prometheus metrics on (/metrics), empty disables")
+	adminon := flag.String("admin", "", "address to serve the admin interface on (/pool dumps the live pool), empty disables. it exposes proxies' credentials, keep it local")
+	statefile := flag.String("state", "", "path to file where proxies' statistics are kept across restarts, empty disables")
+	stateint := flag.Duration("stateint", time.Minute, "how often to save the state")
+	loglevel := flag.String("loglevel", "info", "min level of logged messages: debug, info, warn or error")
+	logformat := flag.String("logformat", "text", "log format: text or json")
+	logfile := flag.String("logfile", "", "path to log file, empty logs to stdout")
+	logmaxsize := flag.Int64("logmaxsize", 100<<20, "rotate log file when it grows bigger than this many bytes, 0 disables rotation")
+	logbackups := flag.Int("logbackups", 5, "how many rotated log files to keep")
+	usersfile := flag.String("users", "", "path to file with \"user:password [bw=|bwup=|bwdown=|quota=size]\" lines, enables socks5 username/password authentication. empty disables")
+	accesslog := flag.String("accesslog", "", "path to access log file (a line per relayed connection), \"-\" is stdout, empty disables")
+	accessformat := flag.String("accessformat", "json", "access log format: json or clf")
+	idle := flag.Duration("idle", constants.SRVIDLETO, "close relays with no data moving in either direction for this long, 0 disables")
+	maxlife := flag.Duration("maxlife", 0, "close relays older than this, 0 disables")
+	maxconns := flag.Int("maxconns", 0, "max concurrent client connections, 0 is unlimited")
+	maxconnsip := flag.Int("maxconnsip", 0, "max concurrent connections from one client ip, 0 is unlimited")
+	maxconnsuser := flag.Int("maxconnsuser", 0, "max concurrent connections of one user, 0 is unlimited")
+	connrate := flag.Float64("connrate", 0, "max new connections per second from one client ip, 0 is unlimited")
+	connburst := flag.Int("connburst", 10, "how many connections over -connrate a client ip can open at once")
+	prxmaxconns := flag.Int("prxmaxconns", 0, "max concurrent relays through one proxy (saturated proxies are skipped), 0 is unlimited")
+	maxup := flag.Int64("maxup", 0, "bandwidth from all clients together in bytes per second, 0 is unlimited")
+	maxdown := flag.Int64("maxdown", 0, "bandwidth to all clients together in bytes per second, 0 is unlimited")
+	prxmaxup := flag.Int64("prxmaxup", 0, "bandwidth to each proxy in bytes per second, 0 is unlimited")
+	prxmaxdown := flag.Int64("prxmaxdown", 0, "bandwidth from each proxy in bytes per second, 0 is unlimited")
+	quotaperiod := flag.Duration("quotaperiod", constants.SRVQUOTAPERIOD, "how often users' byte quotas (quota= in the users file) are renewed")
+	aclfile := flag.String("acl", "", "path to file with \"allow|deny client|dest cidr|ip|private|any\" rules, first matching rule wins. empty allows everything")
+	aclint := flag.Duration("aclint", constants.SRVACLRELOAD, "how often the acl file is checked for changes")
+	grace := flag.Duration("grace", constants.SRVGRACE, "how long to wait for active connections on shutdown before closing them")
 	flag.Parse()
-	if *pfile == "" {
-		logging.Fatal("pfile arg is empty")
+
+	var logcfg logging.Config
+	var err error
+	if logcfg.Level, err = logging.ParseLevel(*loglevel); err != nil {
+		logging.Fatal("bad loglevel arg", "error", err)
+	}
+	if logcfg.JSON, err = logging.ParseFormat(*logformat); err != nil {
+		logging.Fatal("bad logformat arg", "error", err)
+	}
+	logcfg.File, logcfg.MaxSize, logcfg.MaxBackups = *logfile, *logmaxsize, *logbackups
+	if err := logging.Init(logcfg); err != nil {
+		logging.Fatal("unable to open log file", "file", *logfile, "error", err)
 	}
 
-	pm := proxy.NewProxyManager()
-	err := pm.ParseFile(*pfile)
+	if *pfile == "" && *sourcesfile == "" {
+		logging.Fatal("pfile and sources args are empty")
+	}
+	var sources []*source.Source
+	if *sourcesfile != "" {
+		sources, err = source.Load(*sourcesfile)
+		if err != nil {
+			logging.Fatal("unable to load sources", "file", *sourcesfile, "error", err)
+		}
+	}
+
+	if *ewma <= 0 || *ewma > 1 {
+		logging.Fatal("ewma must be in (0, 1]")
+	}
+
+	penalties, err := proxy.ParsePenalties(*penalty)
 	if err != nil {
-		logging.Fatal("got err while parsing " + *pfile + " :" + err.Error())
+		logging.Fatal("bad penalty arg", "error", err)
 	}
-	checker.StartChecking(*checkingn, pm)
 
-	proxiesChannel := make(chan chan proxy.Message)
-	go pm.ServeProxies(proxiesChannel)
+	srvcfg := &server.Config{
+		Listen:          *listenon,
+		Grace:           *grace,
+		IdleTimeout:     *idle,
+		MaxLifetime:     *maxlife,
+		MaxConns:        *maxconns,
+		MaxConnsPerIP:   *maxconnsip,
+		MaxConnsPerUser: *maxconnsuser,
+		ConnRate:        *connrate,
+		ConnBurst:       *connburst,
+		MaxUp:           *maxup,
+		MaxDown:         *maxdown,
+		PrxMaxUp:        *prxmaxup,
+		PrxMaxDown:      *prxmaxdown,
+		QuotaPeriod:     *quotaperiod,
+	}
+	if *usersfile != "" {
+		srvcfg.Users, err = server.LoadUsers(*usersfile)
+		if err != nil {
+			logging.Fatal("unable to load users", "file", *usersfile, "error", err)
+		}
+	}
+	if *aclfile != "" {
+		srvcfg.ACL, err = server.LoadACL(*aclfile)
+		if err != nil {
+			logging.Fatal("unable to load acl", "file", *aclfile, "error", err)
+		}
+	}
+	if *accesslog != "" {
+		srvcfg.AccessLog, err = server.NewAccessLog(*accesslog, *accessformat, *logmaxsize, *logbackups)
+		if err != nil {
+			logging.Fatal("unable to open access log", "file", *accesslog, "error", err)
+		}
+	}
+
+	pm := proxy.NewProxyManager()
+	pm.SetLatencyAlpha(*ewma)
+	pm.SetPenalties(penalties)
+	pm.SetBreaker(*brkwindow, *brkmin, *brkrate, *brkcd)
+	pm.SetProbing(uint8(min(*promote, 255)), *maxdead)
+	pm.SetMaxConns(*prxmaxconns)
+	if *statefile != "" {
+		if err := pm.LoadState(*statefile); err != nil {
+			logging.Error("unable to load state", "file", *statefile, "error", err)
+		}
+	}
+	// ctx is done on SIGINT/SIGTERM and stops the listener (and anything before it),
+	// bgctx is done once the listener has drained and stops everything else
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	// once shutting down, a second signal kills the program instead of waiting for it
+	context.AfterFunc(ctx, stopSignals)
+	bgctx, stopBg := context.WithCancel(context.Background())
+	defer stopBg()
 
-	server.ListenAndServe(*listenon, proxiesChannel)
+	if *pfile != "" {
+		err = pm.ParseFile(*pfile, proxy.ParseOptions{Proto: *pproto, Strict: *strict, Detect: checker.Detector(ctx, *checkingn)})
+		failOnBadEntries(err)
+		if err != nil {
+			logging.Fatal("unable to parse pfile", "file", *pfile, "error", err)
+		}
+	}
+
+	var probes checker.Probes
+	if *bwurl != "" {
+		probes.BW, err = checker.NewBWProbe(*bwurl, *bwsize)
+		if err != nil {
+			logging.Fatal("bad bwurl arg", "url", *bwurl, "error", err)
+		}
+		pm.SetThroughputRanking(*bwweight, *bwint)
+	} else {
+		pm.SetThroughputRanking(*bwweight, 0)
+	}
+	if *exitipurl != "" {
+		probes.IP, err = checker.NewIPProbe(*exitipurl)
+		if err != nil {
+			logging.Fatal("bad exitipurl arg", "url", *exitipurl, "error", err)
+		}
+		pm.SetExitIPProbing(*exitipint)
+	}
+	if *statsint > 0 {
+		go pm.ServeStatsLog(bgctx, *statsint)
+	}
+	if *metricson != "" {
+		metrics.NewGaugeFunc("proxyflow_pool_proxies", "Proxies in the pool by state (good or bad).", "state",
+			func() map[string]float64 {
+				good, bad := pm.PoolSizes()
+				return map[string]float64{"good": float64(good), "bad": float64(bad)}
+			})
+		go metrics.ListenAndServe(*metricson)
+	}
+	if *adminon != "" {
+		go admin.ListenAndServe(*adminon, pm)
+	}
+	var saver sync.WaitGroup
+	if *statefile != "" {
+		saver.Go(func() { pm.ServeStateSaver(bgctx, *statefile, *stateint) })
+	}
+	if len(sources) != 0 {
+		failOnBadEntries(source.RefreshAll(ctx, pm, sources, *strict))
+		source.Serve(bgctx, pm, sources)
+	}
+	if srvcfg.ACL != nil {
+		go srvcfg.ACL.ServeReload(bgctx, *aclint)
+	}
+	waitCheckers := checker.StartChecking(bgctx, *checkingn, pm, probes)
+
+	server.ListenAndServe(ctx, srvcfg, pm)
+
+	logging.Info("shutting down")
+	stopBg()
+	// the state is saved once checks in flight and the periodic saver are done
+	waitCheckers()
+	saver.Wait()
+	if *statefile != "" {
+		if err := pm.SaveState(*statefile); err != nil {
+			logging.Error("unable to save state", "file", *statefile, "error", err)
+		}
+	}
+	pm.StopXray()
+}
+
+// prints file:line of every bad entry and exits if err is a proxy.ListError
+func failOnBadEntries(err error) {
+	var lerr proxy.ListError
+	if !errors.As(err, &lerr) {
+		return
+	}
+	for _, d := range lerr {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	logging.Fatal("proxy list has bad entries", "count", len(lerr))
 }
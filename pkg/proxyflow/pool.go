@@ -0,0 +1,255 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package proxyflow embeds a proxyflow pool into a program: connections are made
+// through the best of its proxies, failing over to others, while the pool is
+// health checked in the background. Pool.DialContext fits http.Transport.DialContext
+// and golang.org/x/net/proxy.ContextDialer
+package proxyflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etidart/proxyflow/internal/checker"
+	"github.com/etidart/proxyflow/internal/connector"
+	"github.com/etidart/proxyflow/internal/constants"
+	"github.com/etidart/proxyflow/internal/proxy"
+)
+
+// Options of a pool, at least one of Proxies and File is needed
+type Options struct {
+	Proxies []string // lines of a proxy list: urls or share links, with options as in a pfile
+	File    string   // proxy list in any of the supported formats
+	Proto   string   // protocol of entries without a scheme: http, https, socks4, socks5 or detect
+
+	Checkers  int           // how many proxies are checked at once, 0 is 10
+	Retries   int           // how many other proxies a dial tries after the first one fails, 0 is 3, negative is none
+	MaxConns  int           // how many connections a proxy can serve at once, 0 is unlimited
+	StateFile string        // where proxies' statistics are kept across restarts, empty disables
+	StateInt  time.Duration // how often the state is saved, 0 is a minute
+
+	Logger *slog.Logger // what the pool logs to, nil is slog.Default()
+}
+
+// ErrNoProxies is returned by dials when the pool has no proxy to use
+var ErrNoProxies = proxy.ErrNoProxies
+
+// Pool is a pool of proxies to dial through. it is safe for concurrent use
+type Pool struct {
+	pm        *proxy.ProxyManager
+	retries   int
+	stateFile string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	bg     sync.WaitGroup // checkers and the state saver
+}
+
+// New makes a pool and starts checking its proxies. bad entries of the lists fail it
+func New(opts Options) (*Pool, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if len(opts.Proxies) == 0 && opts.File == "" {
+		return nil, errors.New("proxyflow: no proxies and no file")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		pm:        proxy.NewProxyManager(),
+		retries:   opts.Retries,
+		stateFile: opts.StateFile,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	switch {
+	case p.retries == 0:
+		p.retries = constants.SRVMAXRETRIES
+	case p.retries < 0:
+		p.retries = 0
+	}
+	checkers := opts.Checkers
+	if checkers <= 0 {
+		checkers = 10
+	}
+	p.pm.SetLogger(opts.Logger)
+	p.pm.SetMaxConns(opts.MaxConns)
+	if opts.StateFile != "" {
+		if err := p.pm.LoadState(opts.StateFile); err != nil {
+			cancel()
+			return nil, fmt.Errorf("proxyflow: loading state: %w", err)
+		}
+	}
+
+	parseOpts := proxy.ParseOptions{Proto: opts.Proto, Strict: true, Logger: opts.Logger, Detect: checker.Detector(ctx, checkers)}
+	if len(opts.Proxies) != 0 {
+		popts := parseOpts
+		popts.Format, popts.Name = proxy.FormatLines, "options"
+		proxies, err := proxy.Parse([]byte(strings.Join(opts.Proxies, "\n")), popts)
+		if err != nil {
+			p.stop()
+			return nil, fmt.Errorf("proxyflow: %w", err)
+		}
+		if _, _, err := p.pm.SetSource(popts.Name, proxies); err != nil {
+			p.stop()
+			return nil, fmt.Errorf("proxyflow: %w", err)
+		}
+	}
+	if opts.File != "" {
+		if err := p.pm.ParseFile(opts.File, parseOpts); err != nil {
+			p.stop()
+			return nil, fmt.Errorf("proxyflow: %w", err)
+		}
+	}
+	if good, bad := p.pm.PoolSizes(); good+bad == 0 {
+		p.stop()
+		return nil, ErrNoProxies
+	}
+
+	p.bg.Go(checker.StartChecking(ctx, checkers, p.pm, checker.Probes{}))
+	if opts.StateFile != "" {
+		every := opts.StateInt
+		if every <= 0 {
+			every = time.Minute
+		}
+		p.bg.Go(func() { p.pm.ServeStateSaver(ctx, opts.StateFile, every) })
+	}
+	return p, nil
+}
+
+// Dial is DialContext with the background context
+func (p *Pool) Dial(network string, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr (host:port, hosts are resolved locally to ipv4) through
+// the best proxy of the pool, trying others if it fails. network must be tcp or tcp4.
+// the connection must be closed, the proxy counts it until then
+func (p *Pool) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	target, err := resolve(ctx, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var lastErr error
+	for try := 0; try <= p.retries; try++ {
+		if try != 0 {
+			select {
+			case <-time.After(constants.SRVRETRYCD):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		conn, err := p.connect(ctx, target)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil || p.ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("proxyflow: dial %s: %w", addr, lastErr)
+}
+
+// connects to target through a proxy leased from the manager and reports how it went
+func (p *Pool) connect(ctx context.Context, target connector.ConnectWho) (net.Conn, error) {
+	if p.ctx.Err() != nil {
+		return nil, errClosed
+	}
+	lease, err := p.pm.Acquire(ctx, proxy.Criteria{Purpose: proxy.Relay})
+	if err != nil {
+		return nil, err
+	}
+	pconn, err, dur := connector.ConnectToPrx(ctx, lease.Prx, target)
+	if err != nil {
+		lease.Report(proxy.Result{Err: err})
+		lease.Release()
+		return nil, fmt.Errorf("%s: %w", lease.Prx.Address, err)
+	}
+	lease.Report(proxy.Result{Dur: dur})
+	return &conn{Conn: pconn, lease: lease}, nil
+}
+
+var errClosed = errors.New("proxyflow: pool is closed")
+
+// Size tells how many proxies the pool has, good ones and ones cut off by their breakers
+func (p *Pool) Size() (good int, bad int) {
+	return p.pm.PoolSizes()
+}
+
+// Close stops checking proxies and saves the state once the checkers are done.
+// connections made by the pool stay open. xray (for share links) is shared by pools
+// and stopped when the last pool using it is closed
+func (p *Pool) Close() error {
+	p.cancel()
+	p.bg.Wait()
+	defer p.pm.StopXray()
+	if p.stateFile != "" {
+		if err := p.pm.SaveState(p.stateFile); err != nil {
+			return fmt.Errorf("proxyflow: saving state: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p *Pool) stop() {
+	p.cancel()
+	p.pm.StopXray()
+}
+
+// resolves addr (host:port) to what proxies connect to
+func resolve(ctx context.Context, addr string) (connector.ConnectWho, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return connector.ConnectWho{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return connector.ConnectWho{}, errors.New("bad port " + portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			return connector.ConnectWho{}, errors.New("only ipv4 targets are supported")
+		}
+		return connector.ConnectWho{IP: ip.String(), Port: uint16(port)}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return connector.ConnectWho{}, err
+	}
+	return connector.ConnectWho{IP: ips[0].String(), Port: uint16(port)}, nil
+}
+
+// conn gives its proxy back to the pool when it is closed
+type conn struct {
+	net.Conn
+	lease *proxy.Lease
+}
+
+func (c *conn) Close() error {
+	c.lease.Release()
+	return c.Conn.Close()
+}
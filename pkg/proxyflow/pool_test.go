@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2025 Arseniy Astankov
+ *
+ * This file is part of proxyflow.
+ *
+ * proxyflow is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+ *
+ * proxyflow is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with proxyflow. If not, see <https://www.gnu.org/licenses/>.
+ */
+package proxyflow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// serves socks5 without auth, connecting to ipv4 targets only
+func socks5Server(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks5(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveSocks5(conn net.Conn) {
+	defer conn.Close()
+	buff := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buff[:2]); err != nil || buff[0] != 0x05 {
+		return
+	}
+	if _, err := io.ReadFull(conn, buff[:buff[1]]); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buff[:10]); err != nil || buff[1] != 0x01 || buff[3] != 0x01 {
+		return
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(buff[8:10])))
+	target, err := net.Dial("tcp4", net.JoinHostPort(net.IP(buff[4:8]).String(), port))
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	if _, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// echoes everything back
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// a pool line of a local socks5 proxy checked against a local url, so tests don't
+// need the network
+func proxyLine(t *testing.T) string {
+	t.Helper()
+	check := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(check.Close)
+	return "socks5://" + socks5Server(t) + " check.url=" + check.URL + "/"
+}
+
+func discard() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
+}
+
+func TestNewNoProxies(t *testing.T) {
+	if _, err := New(Options{Logger: discard()}); err == nil {
+		t.Fatal("New without proxies succeeded")
+	}
+}
+
+func TestNewBadEntry(t *testing.T) {
+	_, err := New(Options{Proxies: []string{"socks5://127.0.0.1:1080 weight=heavy"}, Logger: discard()})
+	if err == nil {
+		t.Fatal("New with a bad entry succeeded")
+	}
+}
+
+func TestDial(t *testing.T) {
+	p, err := New(Options{Proxies: []string{proxyLine(t)}, Logger: discard()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if good, bad := p.Size(); good != 1 || bad != 0 {
+		t.Fatalf("Size() = %d, %d, want 1, 0", good, bad)
+	}
+
+	conn, err := p.Dial("tcp", echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("hello through the pool")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("read %q, want %q", got, msg)
+	}
+
+	if _, err := p.Dial("udp", "127.0.0.1:53"); err == nil {
+		t.Fatal("udp dial succeeded")
+	}
+}
+
+func TestDialAfterClose(t *testing.T) {
+	p, err := New(Options{Proxies: []string{proxyLine(t)}, Logger: discard()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Dial("tcp", echoServer(t)); !errors.Is(err, errClosed) {
+		t.Fatalf("dial after Close: %v, want %v", err, errClosed)
+	}
+}
+
+func TestCloseSavesState(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state.json")
+	line := proxyLine(t)
+	p, err := New(Options{Proxies: []string{line}, StateFile: state, Logger: discard()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(state); err != nil {
+		t.Fatalf("state is not saved: %v", err)
+	}
+
+	// pools log to their own loggers
+	var first, second bytes.Buffer
+	p1, err := New(Options{Proxies: []string{line}, StateFile: state, Logger: slog.New(slog.NewTextHandler(&first, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := New(Options{Proxies: []string{line}, Logger: slog.New(slog.NewTextHandler(&second, nil))})
+	if err != nil {
+		p1.Close()
+		t.Fatal(err)
+	}
+	p1.Close()
+	p2.Close()
+	if !bytes.Contains(first.Bytes(), []byte("loaded state")) {
+		t.Errorf("first pool didn't log loading its state: %q", first.String())
+	}
+	if bytes.Contains(second.Bytes(), []byte("loaded state")) {
+		t.Errorf("second pool logged the first one's state: %q", second.String())
+	}
+}